@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAdminRequestSize bounds the JSON body of admin requests.
+const maxAdminRequestSize = 64 << 10
+
+// adminConfigMu serializes configuration updates, so two PATCH requests cannot
+// both start from the same snapshot and lose one of the changes.
+var adminConfigMu sync.Mutex
+
+// adminConfig is the runtime-tunable part of AppConfig as the admin API shows it.
+type adminConfig struct {
+	MaxUploadSize          int64    `json:"max_upload_size"`
+	RetentionSeconds       int64    `json:"retention_seconds"`
+	CleanupIntervalSeconds int64    `json:"cleanup_interval_seconds"`
+	TrustedProxies         []string `json:"trusted_proxies"`
+}
+
+// adminConfigPatch holds the fields a PATCH request sets; nil fields are kept.
+type adminConfigPatch struct {
+	MaxUploadSize          *int64    `json:"max_upload_size"`
+	RetentionSeconds       *int64    `json:"retention_seconds"`
+	CleanupIntervalSeconds *int64    `json:"cleanup_interval_seconds"`
+	TrustedProxies         *[]string `json:"trusted_proxies"`
+}
+
+func newAdminConfig(cfg *AppConfig) adminConfig {
+	return adminConfig{
+		MaxUploadSize:          cfg.MaxUploadSize,
+		RetentionSeconds:       cfg.RetentionSeconds,
+		CleanupIntervalSeconds: cfg.CleanupIntervalSeconds,
+		TrustedProxies:         cfg.TrustedProxies,
+	}
+}
+
+// requireAdminToken guards /admin with "Authorization: Bearer <XTEMP_ADMIN_TOKEN>".
+// The admin API does not exist while no token is configured.
+func requireAdminToken(c *gin.Context) {
+	expected := currentConfig().AdminToken
+	if expected == "" {
+		abortWithError(c, http.StatusNotFound, "Admin API is disabled", nil)
+		return
+	}
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(expected)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="xtemp-admin"`)
+		abortWithError(c, http.StatusUnauthorized, "Unauthorized", nil)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Next()
+}
+
+// handleGetAdminConfig answers GET /admin/config.
+func handleGetAdminConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, newAdminConfig(currentConfig()))
+}
+
+// handlePatchAdminConfig answers PATCH /admin/config. Every field is validated
+// before any is applied, and the new configuration replaces the old one as a
+// whole.
+func handlePatchAdminConfig(c *gin.Context) {
+	var patch adminConfigPatch
+	decoder := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, maxAdminRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid JSON body", err)
+		return
+	}
+	if err := patch.validate(); err != nil {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("Invalid configuration: %v", err), nil)
+		return
+	}
+
+	adminConfigMu.Lock()
+	defer adminConfigMu.Unlock()
+	old := currentConfig()
+	next := *old
+	if patch.MaxUploadSize != nil {
+		next.MaxUploadSize = *patch.MaxUploadSize
+	}
+	if patch.RetentionSeconds != nil {
+		next.RetentionSeconds = *patch.RetentionSeconds
+	}
+	if patch.CleanupIntervalSeconds != nil {
+		next.CleanupIntervalSeconds = *patch.CleanupIntervalSeconds
+	}
+	if patch.TrustedProxies != nil {
+		next.TrustedProxies = slices.Clone(*patch.TrustedProxies)
+	}
+	// The engine carries the trusted proxies and the multipart memory limit,
+	// so it is rebuilt whenever one of them changes.
+	var engine *gin.Engine
+	if !slices.Equal(next.TrustedProxies, old.TrustedProxies) || next.MaxUploadSize != old.MaxUploadSize {
+		var err error
+		if engine, err = newRouter(&next); err != nil {
+			abortWithError(c, http.StatusBadRequest, "Invalid trusted proxies", err)
+			return
+		}
+	}
+	activeConfig.Store(&next)
+	if engine != nil {
+		router.engine.Store(engine)
+	}
+	if next.CleanupIntervalSeconds != old.CleanupIntervalSeconds {
+		rescheduleCleanup()
+	}
+	requestLogger(c).Info("Configuration updated by admin API", "ip", c.ClientIP(), "config", newAdminConfig(&next))
+	c.JSON(http.StatusOK, newAdminConfig(&next))
+}
+
+func (patch adminConfigPatch) validate() error {
+	if patch.MaxUploadSize != nil && *patch.MaxUploadSize <= 0 {
+		return errors.New("max_upload_size must be positive")
+	}
+	if patch.RetentionSeconds != nil && *patch.RetentionSeconds <= 0 {
+		return errors.New("retention_seconds must be positive")
+	}
+	if patch.CleanupIntervalSeconds != nil && *patch.CleanupIntervalSeconds <= 0 {
+		return errors.New("cleanup_interval_seconds must be positive")
+	}
+	if patch.TrustedProxies != nil {
+		for _, proxy := range *patch.TrustedProxies {
+			if !validTrustedProxy(proxy) {
+				return fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", proxy)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// newAdminTestServer serves the router with the admin API enabled. The engine
+// and configuration a PATCH installs are put back when the test ends.
+func newAdminTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	useMemoryStorage(t)
+	useConfig(t, func(cfg *AppConfig) {
+		cfg.AdminToken = "admin-secret"
+		cfg.MaxUploadSize = 1000
+		cfg.RetentionSeconds = 3600
+		cfg.CleanupIntervalSeconds = 60
+	})
+	r, err := newRouter(currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := router.engine.Load()
+	t.Cleanup(func() {
+		router.engine.Store(previous)
+		select {
+		case <-cleanupRescheduled:
+		default:
+		}
+	})
+	return r
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	handler := newAdminTestServer(t)
+	tests := []struct {
+		authorization string
+		wantStatus    int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"admin-secret", http.StatusUnauthorized},
+		{"Basic YWRtaW4tc2VjcmV0", http.StatusUnauthorized},
+		{"Bearer admin-secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		header := map[string]string{"Authorization": tt.authorization}
+		w := serveRequest(handler, http.MethodGet, "/admin/config", header, "")
+		if w.Code != tt.wantStatus {
+			t.Errorf("Authorization %q: status %d, want %d", tt.authorization, w.Code, tt.wantStatus)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: no WWW-Authenticate header", tt.authorization)
+		}
+	}
+
+	useConfig(t, func(cfg *AppConfig) { cfg.AdminToken = "" })
+	header := map[string]string{"Authorization": "Bearer "}
+	if w := serveRequest(handler, http.MethodGet, "/admin/config", header, ""); w.Code != http.StatusNotFound {
+		t.Errorf("without a configured token: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminGetConfig(t *testing.T) {
+	handler := newAdminTestServer(t)
+	w := serveRequest(handler, http.MethodGet, "/admin/config", map[string]string{"Authorization": "Bearer admin-secret"}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	var got adminConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxUploadSize != 1000 || got.RetentionSeconds != 3600 || got.CleanupIntervalSeconds != 60 {
+		t.Errorf("config = %+v, want the configured limits", got)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestAdminPatchConfigValidates(t *testing.T) {
+	handler := newAdminTestServer(t)
+	header := map[string]string{"Authorization": "Bearer admin-secret", "Content-Type": "application/json"}
+	bodies := []string{
+		`{"max_upload_size": 0}`,
+		`{"max_upload_size": -5}`,
+		`{"retention_seconds": 0}`,
+		`{"cleanup_interval_seconds": -1}`,
+		`{"trusted_proxies": ["not-an-ip"]}`,
+		`{"max_upload_size": 10, "retention_seconds": 0}`,
+		`{"unknown_field": 1}`,
+		`{"max_upload_size": "big"}`,
+		`not json`,
+	}
+	for _, body := range bodies {
+		if w := serveRequest(handler, http.MethodPatch, "/admin/config", header, body); w.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %s: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	// A rejected patch changes nothing, not even its valid fields.
+	if cfg := currentConfig(); cfg.MaxUploadSize != 1000 || cfg.RetentionSeconds != 3600 {
+		t.Errorf("config after rejected patches: max_upload_size %d, retention_seconds %d", cfg.MaxUploadSize, cfg.RetentionSeconds)
+	}
+
+	if w := serveRequest(handler, http.MethodPatch, "/admin/config", nil, `{"max_upload_size": 10}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("PATCH without token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if cfg := currentConfig(); cfg.MaxUploadSize != 1000 {
+		t.Errorf("max_upload_size after unauthorized patch = %d, want 1000", cfg.MaxUploadSize)
+	}
+}
+
+func TestAdminPatchConfigApplies(t *testing.T) {
+	handler := newAdminTestServer(t)
+	engine := router.engine.Load()
+	header := map[string]string{"Authorization": "Bearer admin-secret", "Content-Type": "application/json"}
+	w := serveRequest(handler, http.MethodPatch, "/admin/config", header,
+		`{"max_upload_size": 2048, "cleanup_interval_seconds": 30, "trusted_proxies": ["10.0.0.0/8"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	var got adminConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	cfg := currentConfig()
+	if cfg.MaxUploadSize != 2048 || cfg.CleanupIntervalSeconds != 30 || len(cfg.TrustedProxies) != 1 || cfg.TrustedProxies[0] != "10.0.0.0/8" {
+		t.Errorf("config after patch = %+v", newAdminConfig(cfg))
+	}
+	if cfg.RetentionSeconds != 3600 {
+		t.Errorf("retention_seconds = %d, want it kept at 3600", cfg.RetentionSeconds)
+	}
+	if got.MaxUploadSize != cfg.MaxUploadSize || got.CleanupIntervalSeconds != cfg.CleanupIntervalSeconds {
+		t.Errorf("response %+v does not match the new config", got)
+	}
+	if router.engine.Load() == engine {
+		t.Error("router engine was not rebuilt for the new trusted proxies")
+	}
+	select {
+	case <-cleanupRescheduled:
+	default:
+		t.Error("cleanup was not rescheduled for the new interval")
+	}
+}
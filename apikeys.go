@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKey is one entry of XTEMP_API_KEYS_FILE or XTEMP_API_KEYS. Limits left at
+// zero fall back to the server settings.
+type apiKey struct {
+	// Name identifies the key in upload records and logs; Key is the secret.
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// MaxUploadSize replaces MAX_UPLOAD_SIZE for uploads with this key.
+	MaxUploadSize int64 `json:"max_upload_size,omitempty"`
+	// MaxRetentionSeconds shortens the retention of uploads with this key.
+	MaxRetentionSeconds int64 `json:"max_retention_seconds,omitempty"`
+	// MaxStorage caps the bytes held by all live uploads of this key.
+	MaxStorage int64 `json:"max_storage,omitempty"`
+}
+
+// loadAPIKeys reads keys from the JSON array in keysFile, if set, and from
+// keysEnv, a comma-separated list of name:key pairs without limits.
+func loadAPIKeys(keysFile, keysEnv string) ([]apiKey, error) {
+	var keys []apiKey
+	if keysFile != "" {
+		data, err := os.ReadFile(keysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", keysFile, err)
+		}
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", keysFile, err)
+		}
+	}
+	for _, entry := range strings.Split(keysEnv, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, fmt.Errorf("API key entry %q is not name:key", entry)
+		}
+		keys = append(keys, apiKey{Name: strings.TrimSpace(name), Key: strings.TrimSpace(key)})
+	}
+	names := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, errors.New("every API key needs a name and a key")
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("API key name %q is used twice", key.Name)
+		}
+		if key.MaxUploadSize < 0 || key.MaxRetentionSeconds < 0 || key.MaxStorage < 0 {
+			return nil, fmt.Errorf("API key %q has a negative limit", key.Name)
+		}
+		names[key.Name] = true
+	}
+	return keys, nil
+}
+
+// findAPIKey returns the configured key matching token, or nil.
+func findAPIKey(token string) *apiKey {
+	var found *apiKey
+	keys := currentConfig().APIKeys
+	for i := range keys {
+		// Compare against every key so the time taken does not reveal which matched.
+		if subtle.ConstantTimeCompare([]byte(token), []byte(keys[i].Key)) == 1 {
+			found = &keys[i]
+		}
+	}
+	return found
+}
+
+// uploadLimit returns the largest upload the key allows.
+func (key *apiKey) uploadLimit() int64 {
+	if key.MaxUploadSize > 0 {
+		return key.MaxUploadSize
+	}
+	return currentConfig().MaxUploadSize
+}
+
+// uploadGrant is what an API key allows the current upload request. It rides
+// in the request context so the storing code can apply it.
+type uploadGrant struct {
+	key *apiKey
+	// remaining is what is left of the quota set aside for this request from
+	// the key's MaxStorage, or -1 without a quota.
+	remaining int64
+}
+
+type uploadGrantKey struct{}
+
+func grantFrom(ctx context.Context) *uploadGrant {
+	grant, _ := ctx.Value(uploadGrantKey{}).(*uploadGrant)
+	return grant
+}
+
+// uploadKeyName returns the name of the API key behind the upload, or "".
+func uploadKeyName(ctx context.Context) string {
+	if grant := grantFrom(ctx); grant != nil {
+		return grant.key.Name
+	}
+	return ""
+}
+
+// uploadSizeLimit returns how many bytes the next file of the upload may hold.
+func uploadSizeLimit(ctx context.Context) int64 {
+	grant := grantFrom(ctx)
+	if grant == nil {
+		return currentConfig().MaxUploadSize
+	}
+	limit := grant.key.uploadLimit()
+	if grant.remaining >= 0 && grant.remaining < limit {
+		limit = grant.remaining
+	}
+	return limit
+}
+
+// chargeUpload takes size bytes off the storage quota of the upload's key.
+func chargeUpload(ctx context.Context, size int64) {
+	if grant := grantFrom(ctx); grant != nil && grant.remaining >= 0 {
+		grant.remaining = max(grant.remaining-size, 0)
+	}
+}
+
+// uploadRetention returns the longest an upload may be kept.
+func uploadRetention(ctx context.Context) time.Duration {
+	retention := time.Duration(currentConfig().RetentionSeconds) * time.Second
+	if grant := grantFrom(ctx); grant != nil && grant.key.MaxRetentionSeconds > 0 {
+		retention = min(retention, time.Duration(grant.key.MaxRetentionSeconds)*time.Second)
+	}
+	return retention
+}
+
+// keyUsage tracks the bytes held by the live uploads of every API key, so a
+// quota check does not read every upload record. It is filled from the stored
+// records on first use and kept current by saveMetadata and deleteMetadata.
+// Records written by other instances sharing an R2 bucket are only seen at
+// that first load, so there the quota is best-effort. reserved holds, by key
+// name, the quota set aside for uploads still in progress.
+var keyUsage struct {
+	mu       sync.Mutex
+	loaded   bool
+	uploads  map[string]uploadUsage
+	reserved map[string]int64
+}
+
+// uploadUsage is what one upload, by random ID, counts against its key.
+type uploadUsage struct {
+	key       string
+	bytes     int64
+	expiresAt time.Time
+}
+
+// usageOf returns what meta counts against its API key, or false if it counts
+// nothing: it was made without a key or can no longer be downloaded.
+func usageOf(meta *uploadMetadata, now time.Time) (uploadUsage, bool) {
+	if reason := meta.available(now); meta.APIKey == "" || (reason != nil && !errors.Is(reason, errUploadIncomplete)) {
+		return uploadUsage{}, false
+	}
+	usage := uploadUsage{key: meta.APIKey, expiresAt: meta.ExpiresAt}
+	for _, file := range meta.Files {
+		usage.bytes += file.Size
+	}
+	return usage, true
+}
+
+// trackKeyUsage updates keyUsage after meta was stored.
+func trackKeyUsage(meta *uploadMetadata) {
+	keyUsage.mu.Lock()
+	defer keyUsage.mu.Unlock()
+	if !keyUsage.loaded {
+		return
+	}
+	if usage, ok := usageOf(meta, time.Now()); ok {
+		keyUsage.uploads[meta.ID] = usage
+	} else {
+		delete(keyUsage.uploads, meta.ID)
+	}
+}
+
+// untrackKeyUsage drops randomID from keyUsage after its record was deleted.
+func untrackKeyUsage(randomID string) {
+	keyUsage.mu.Lock()
+	defer keyUsage.mu.Unlock()
+	delete(keyUsage.uploads, randomID)
+}
+
+// storageUsed sums the files of every live upload made with the named key.
+func storageUsed(ctx context.Context, name string) (int64, error) {
+	keyUsage.mu.Lock()
+	defer keyUsage.mu.Unlock()
+	return storageUsedLocked(ctx, name)
+}
+
+// storageUsedLocked is storageUsed for callers holding keyUsage.mu.
+func storageUsedLocked(ctx context.Context, name string) (int64, error) {
+	if !keyUsage.loaded {
+		if err := loadKeyUsage(ctx); err != nil {
+			return 0, err
+		}
+	}
+	now := time.Now()
+	var used int64
+	for randomID, usage := range keyUsage.uploads {
+		if !usage.expiresAt.IsZero() && !now.Before(usage.expiresAt) {
+			delete(keyUsage.uploads, randomID)
+			continue
+		}
+		if usage.key == name {
+			used += usage.bytes
+		}
+	}
+	return used, nil
+}
+
+// reserveQuota sets aside up to limit bytes of the storage quota of key for
+// an upload and returns how much it got, along with what the key already
+// uses. It gets nothing once the quota is used up. Reservations count as used
+// until releaseQuota, so uploads checked at the same time cannot overrun the
+// quota together.
+func reserveQuota(ctx context.Context, key *apiKey, limit int64) (reserved, used int64, err error) {
+	keyUsage.mu.Lock()
+	defer keyUsage.mu.Unlock()
+	if used, err = storageUsedLocked(ctx, key.Name); err != nil {
+		return 0, 0, err
+	}
+	used += keyUsage.reserved[key.Name]
+	if used >= key.MaxStorage {
+		return 0, used, nil
+	}
+	reserved = min(key.MaxStorage-used, limit)
+	if keyUsage.reserved == nil {
+		keyUsage.reserved = make(map[string]int64)
+	}
+	keyUsage.reserved[key.Name] += reserved
+	return reserved, used, nil
+}
+
+// releaseQuota gives back a reservation once its upload has finished. What the
+// upload stored is counted through its record by then.
+func releaseQuota(name string, reserved int64) {
+	keyUsage.mu.Lock()
+	defer keyUsage.mu.Unlock()
+	if keyUsage.reserved[name] -= reserved; keyUsage.reserved[name] <= 0 {
+		delete(keyUsage.reserved, name)
+	}
+}
+
+// loadKeyUsage fills keyUsage from every stored upload record. The caller
+// must hold keyUsage.mu.
+func loadKeyUsage(ctx context.Context) error {
+	records, err := store.List(ctx, metadataPrefix)
+	if err != nil {
+		return err
+	}
+	uploads := make(map[string]uploadUsage)
+	now := time.Now()
+	for _, record := range records {
+		randomID := strings.TrimSuffix(strings.TrimPrefix(record.Key, metadataPrefix), ".json")
+		meta, err := loadMetadata(ctx, randomID)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if usage, ok := usageOf(meta, now); ok {
+			uploads[randomID] = usage
+		}
+	}
+	keyUsage.uploads, keyUsage.loaded = uploads, true
+	return nil
+}
+
+// requireAPIKey guards the upload routes when API keys are configured. The
+// request must carry "Authorization: Bearer <key>"; the matching key's limits
+// then apply to the upload.
+func requireAPIKey(c *gin.Context) {
+	if len(currentConfig().APIKeys) == 0 {
+		c.Next()
+		return
+	}
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	key := findAPIKey(strings.TrimSpace(token))
+	if !found || key == nil {
+		c.Header("WWW-Authenticate", `Bearer realm="xtemp"`)
+		abortWithError(c, http.StatusUnauthorized, "A valid API key is required to upload", nil)
+		return
+	}
+	grant := &uploadGrant{key: key, remaining: -1}
+	if key.MaxStorage > 0 {
+		reserved, used, err := reserveQuota(c.Request.Context(), key, key.uploadLimit())
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, "Failed to check storage quota", err)
+			return
+		}
+		if reserved == 0 {
+			abortWithError(c, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Storage quota of API key %s is used up (%d of %d bytes)", key.Name, used, key.MaxStorage), nil)
+			return
+		}
+		defer releaseQuota(key.Name, reserved)
+		grant.remaining = reserved
+	}
+	requestLogger(c).Info("Upload authorized with API key", "api_key", key.Name, "ip", c.ClientIP())
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), uploadGrantKey{}, grant))
+	c.Next()
+}
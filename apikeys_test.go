@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func saveTestRecord(t *testing.T, meta *uploadMetadata) {
+	t.Helper()
+	if err := saveMetadata(context.Background(), meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func keyRecord(randomID, key string, sizes ...int64) *uploadMetadata {
+	meta := &uploadMetadata{ID: randomID, APIKey: key, ExpiresAt: time.Now().Add(time.Hour)}
+	for _, size := range sizes {
+		meta.Files = append(meta.Files, fileMetadata{Size: size})
+	}
+	return meta
+}
+
+func checkStorageUsed(t *testing.T, name string, want int64) {
+	t.Helper()
+	used, err := storageUsed(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != want {
+		t.Errorf("storage used by %s = %d, want %d", name, used, want)
+	}
+}
+
+func TestStorageUsedFollowsRecords(t *testing.T) {
+	useMemoryStorage(t)
+	ctx := context.Background()
+	// Stored before the usage is first loaded.
+	saveTestRecord(t, keyRecord("aaaaaaaaaaaa", "ci", 10, 5))
+	saveTestRecord(t, keyRecord("bbbbbbbbbbbb", "other", 100))
+	saveTestRecord(t, keyRecord("cccccccccccc", "", 1000))
+	checkStorageUsed(t, "ci", 15)
+
+	saveTestRecord(t, keyRecord("dddddddddddd", "ci", 7))
+	checkStorageUsed(t, "ci", 22)
+	saveTestRecord(t, keyRecord("aaaaaaaaaaaa", "ci", 10))
+	checkStorageUsed(t, "ci", 17)
+	if err := deleteMetadata(ctx, "dddddddddddd"); err != nil {
+		t.Fatal(err)
+	}
+	checkStorageUsed(t, "ci", 10)
+
+	expiring := keyRecord("eeeeeeeeeeee", "ci", 3)
+	expiring.ExpiresAt = time.Now().Add(50 * time.Millisecond)
+	saveTestRecord(t, expiring)
+	checkStorageUsed(t, "ci", 13)
+	time.Sleep(60 * time.Millisecond)
+	checkStorageUsed(t, "ci", 10)
+
+	usedUp := keyRecord("ffffffffffff", "ci", 4)
+	usedUp.MaxDownloads, usedUp.Downloads = 1, 1
+	saveTestRecord(t, usedUp)
+	checkStorageUsed(t, "ci", 10)
+
+	unfinished := keyRecord("gggggggggggg", "ci", 20)
+	unfinished.Resumable = &ChunkedUpload{Length: 20}
+	saveTestRecord(t, unfinished)
+	checkStorageUsed(t, "ci", 30)
+	checkStorageUsed(t, "other", 100)
+}
+
+func TestRequireAPIKeyEnforcesStorageQuota(t *testing.T) {
+	useMemoryStorage(t)
+	useConfig(t, func(cfg *AppConfig) {
+		cfg.APIKeys = []apiKey{{Name: "ci", Key: "secret", MaxStorage: 10}}
+	})
+	r, err := newRouter(currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(name, token, content string) int {
+		req := httptest.NewRequest(http.MethodPut, "/"+name, strings.NewReader(content))
+		req.Header.Set("User-Agent", "curl/8.0")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	steps := []struct {
+		name, token, content string
+		wantStatus           int
+	}{
+		{"a.txt", "", "abc", http.StatusUnauthorized},
+		{"a.txt", "wrong", "abc", http.StatusUnauthorized},
+		{"a.txt", "secret", "abcdef", http.StatusCreated},
+		{"b.txt", "secret", "abcdef", http.StatusRequestEntityTooLarge},
+		{"c.txt", "secret", "abcd", http.StatusCreated},
+		{"d.txt", "secret", "a", http.StatusRequestEntityTooLarge},
+	}
+	for _, step := range steps {
+		if status := put(step.name, step.token, step.content); status != step.wantStatus {
+			t.Errorf("PUT %s with %d bytes and key %q: status %d, want %d", step.name, len(step.content), step.token, status, step.wantStatus)
+		}
+	}
+	checkStorageUsed(t, "ci", 10)
+}
+
+func TestReserveQuota(t *testing.T) {
+	useMemoryStorage(t)
+	key := &apiKey{Name: "ci", Key: "secret", MaxStorage: 10, MaxUploadSize: 4}
+	ctx := context.Background()
+	tests := []struct {
+		wantReserved, wantUsed int64
+	}{
+		{4, 0},
+		{4, 4},
+		{2, 8},
+		{0, 10},
+	}
+	for i, tt := range tests {
+		reserved, used, err := reserveQuota(ctx, key, key.uploadLimit())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reserved != tt.wantReserved || used != tt.wantUsed {
+			t.Errorf("reservation %d: got %d with %d used, want %d with %d used", i+1, reserved, used, tt.wantReserved, tt.wantUsed)
+		}
+	}
+	releaseQuota(key.Name, 4)
+	if reserved, used, _ := reserveQuota(ctx, key, key.uploadLimit()); reserved != 4 || used != 6 {
+		t.Errorf("after a release: got %d with %d used, want 4 with 6 used", reserved, used)
+	}
+}
@@ -1,19 +1,13 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"sync/atomic"
 )
 
 const (
@@ -22,18 +16,45 @@ const (
 	envMaxUploadSize     = "MAX_UPLOAD_SIZE"
 	envRetentionSeconds  = "XTEMP_RETENTION_SECONDS"
 	envCleanupInterval   = "XTEMP_CLEANUP_INTERVAL_SECONDS"
+	envShutdownTimeout   = "XTEMP_SHUTDOWN_TIMEOUT_SECONDS"
+	envMaxDownloadsLimit = "XTEMP_MAX_DOWNLOADS_LIMIT"
+	envMaxArchiveSize    = "XTEMP_MAX_ARCHIVE_SIZE"
+	envDedup             = "XTEMP_DEDUP"
+	envMinFreeSpace      = "XTEMP_MIN_FREE_SPACE"
 	envStorageType       = "STORAGE_TYPE"
 	envR2AccountID       = "R2_ACCOUNT_ID"
 	envR2AccessKeyID     = "R2_ACCESS_KEY_ID"
 	envR2SecretAccessKey = "R2_SECRET_ACCESS_KEY"
 	envR2BucketName      = "R2_BUCKET_NAME"
 	envConfigAPIPassword = "XTEMP_CONFIG_API_PASSWORD"
+	envAdminToken        = "XTEMP_ADMIN_TOKEN"
+	envSigningSecret     = "XTEMP_SIGNING_SECRET"
+	envSignedOnly        = "XTEMP_SIGNED_ONLY"
+	envAPIKeysFile       = "XTEMP_API_KEYS_FILE"
+	envAPIKeys           = "XTEMP_API_KEYS"
+	envLogFormat         = "XTEMP_LOG_FORMAT"
+	envLogLevel          = "XTEMP_LOG_LEVEL"
 
-	defaultStoragePath   = "/var/lib/xtemp-store"
-	defaultMaxUploadSize = 50 << 20
+	defaultStoragePath            = "/var/lib/xtemp-store"
+	defaultMaxUploadSize          = 50 << 20
+	defaultMaxArchiveSize         = 1 << 30
 	defaultRetentionSeconds int64 = 24 * 3600
 	defaultCleanupInterval  int64 = 3600
-	bufferSize           = 16 * 1024
+	defaultShutdownTimeout  int64 = 20
+	defaultMinFreeSpace           = 100 << 20
+	bufferSize                    = 16 * 1024
+
+	deleteTokenHeader  = "X-Delete-Token"
+	maxDaysHeader      = "Max-Days"
+	maxDownloadsHeader = "Max-Downloads"
+	extractHeader      = "X-Extract"
+	encryptHeader      = "X-Encrypt"
+
+	downloadPasswordHeader = "X-Download-Password"
+	requestIDHeader        = "X-Request-Id"
+
+	expectedSHA256Header = "X-Expected-Sha256"
+	expectedMD5Header    = "X-Expected-Md5"
 
 	dirPerm  os.FileMode = 0750
 	filePerm os.FileMode = 0640
@@ -47,56 +68,75 @@ const (
 )
 
 type AppConfig struct {
-	BaseStoragePath   string
-	MaxUploadSize     int64
+	BaseStoragePath        string
+	MaxUploadSize          int64
 	RetentionSeconds       int64
 	CleanupIntervalSeconds int64
-	TrustedProxies    []string
-	StorageType       StorageType
-	R2AccountID       string
-	R2AccessKeyID     string
-	R2SecretAccessKey string
-	R2BucketName      string
+	ShutdownTimeoutSeconds int64
+	MaxDownloadsLimit      int64
+	MaxArchiveSize         int64
+	Dedup                  bool
+	MinFreeSpace           int64
+	TrustedProxies         []string
+	StorageType            StorageType
+	R2AccountID            string
+	R2AccessKeyID          string
+	R2SecretAccessKey      string
+	R2BucketName           string
+	AdminToken             string
+	SigningSecret          string
+	SignedOnly             bool
+	APIKeys                []apiKey
 }
 
 var (
-	logger   *log.Logger
-	config   *AppConfig
-	s3Client *s3.S3
-	r2Bucket string
+	logger *slog.Logger
+	// activeConfig holds the running configuration. It is replaced as a whole,
+	// never modified in place, so readers always see a consistent snapshot.
+	activeConfig atomic.Pointer[AppConfig]
 )
 
+// currentConfig returns the configuration in effect. Callers must not modify it.
+func currentConfig() *AppConfig {
+	return activeConfig.Load()
+}
+
 func init() {
-	logger = log.New(os.Stdout, "xtemp_app: ", log.Ldate|log.Ltime|log.Lshortfile)
-	config = loadConfig()
+	logger = newLogger(os.Getenv(envLogFormat), os.Getenv(envLogLevel))
+	activeConfig.Store(loadConfig())
+}
 
-	switch config.StorageType {
-	case StorageLocal:
-		if err := os.MkdirAll(config.BaseStoragePath, dirPerm); err != nil {
-			logger.Fatalf("Could not create base storage directory %s: %v", config.BaseStoragePath, err)
-		}
-		logger.Printf("Base storage directory %s ensured with permissions %o", config.BaseStoragePath, dirPerm)
-	case StorageR2:
-		endpoint := fmt.Sprintf("https://%s.r2.cloudflarestorage.com", config.R2AccountID)
-		sess, err := session.NewSession(&aws.Config{
-			Region:           aws.String("auto"),
-			Endpoint:         aws.String(endpoint),
-			S3ForcePathStyle: aws.Bool(true),
-			Credentials:      credentials.NewStaticCredentials(config.R2AccessKeyID, config.R2SecretAccessKey, ""),
-		})
-		if err != nil {
-			logger.Fatalf("Failed to create R2 session: %v", err)
-		}
-		s3Client = s3.New(sess)
-		r2Bucket = config.R2BucketName
-		logger.Printf("R2 client initialized for endpoint %s, bucket %s", endpoint, r2Bucket)
+// setup creates the storage backend and starts the cleanup worker. It
+// runs from main rather than init, so tests touch no real storage and can
+// install their own store.
+func setup() {
+	config := currentConfig()
+	var err error
+	if store, err = newStorage(config); err != nil {
+		fatal("Failed to initialize storage", "storage", config.StorageType, "error", err)
 	}
 
-	logger.Printf("Max upload size set to %d bytes (%dMB)", config.MaxUploadSize, config.MaxUploadSize/(1<<20))
-	logger.Printf("Retention period set to %s", time.Duration(config.RetentionSeconds)*time.Second)
-	logger.Printf("Cleanup interval set to %s", time.Duration(config.CleanupIntervalSeconds)*time.Second)
-	logger.Printf("Trusted proxies configured: %v", config.TrustedProxies)
-	logger.Printf("Storage type: %s", config.StorageType)
+	logger.Info("Configuration loaded",
+		"storage", config.StorageType,
+		"max_upload_size", config.MaxUploadSize,
+		"max_archive_size", config.MaxArchiveSize,
+		"retention_seconds", config.RetentionSeconds,
+		"cleanup_interval_seconds", config.CleanupIntervalSeconds,
+		"shutdown_timeout_seconds", config.ShutdownTimeoutSeconds,
+		"max_downloads_limit", config.MaxDownloadsLimit,
+		"trusted_proxies", config.TrustedProxies,
+	)
+	if config.Dedup && config.StorageType == StorageLocal {
+		logger.Info("Deduplication of identical local uploads enabled")
+	}
+	if config.SignedOnly {
+		logger.Info("Signed-only mode enabled, unsigned downloads are refused")
+	} else if config.SigningSecret != "" {
+		logger.Info("Signed URLs enabled")
+	}
+	if len(config.APIKeys) > 0 {
+		logger.Info("Uploads require an API key", "keys", len(config.APIKeys))
+	}
 
 	startCleanupWorker()
 }
@@ -105,8 +145,11 @@ func loadConfig() *AppConfig {
 	cfg := &AppConfig{
 		BaseStoragePath:        defaultStoragePath,
 		MaxUploadSize:          defaultMaxUploadSize,
+		MaxArchiveSize:         defaultMaxArchiveSize,
+		MinFreeSpace:           defaultMinFreeSpace,
 		RetentionSeconds:       defaultRetentionSeconds,
 		CleanupIntervalSeconds: defaultCleanupInterval,
+		ShutdownTimeoutSeconds: defaultShutdownTimeout,
 		TrustedProxies:         []string{"127.0.0.1", "::1", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
 		StorageType:            StorageLocal,
 	}
@@ -118,7 +161,15 @@ func loadConfig() *AppConfig {
 		if err == nil && size > 0 {
 			cfg.MaxUploadSize = size
 		} else {
-			logger.Printf("Invalid %s value '%s', using default %dMB", envMaxUploadSize, sizeStr, defaultMaxUploadSize/(1<<20))
+			logger.Warn("Invalid value, using default", "env", envMaxUploadSize, "value", sizeStr, "default", defaultMaxUploadSize)
+		}
+	}
+	if sizeStr := os.Getenv(envMaxArchiveSize); sizeStr != "" {
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err == nil && size > 0 {
+			cfg.MaxArchiveSize = size
+		} else {
+			logger.Warn("Invalid value, using default", "env", envMaxArchiveSize, "value", sizeStr, "default", defaultMaxArchiveSize)
 		}
 	}
 	if retentionSecondsStr := os.Getenv(envRetentionSeconds); retentionSecondsStr != "" {
@@ -126,7 +177,7 @@ func loadConfig() *AppConfig {
 		if err == nil && retentionSeconds > 0 {
 			cfg.RetentionSeconds = retentionSeconds
 		} else {
-			logger.Printf("Invalid %s value '%s', using default %d second(s)", envRetentionSeconds, retentionSecondsStr, defaultRetentionSeconds)
+			logger.Warn("Invalid value, using default", "env", envRetentionSeconds, "value", retentionSecondsStr, "default", defaultRetentionSeconds)
 		}
 	}
 	if cleanupIntervalStr := os.Getenv(envCleanupInterval); cleanupIntervalStr != "" {
@@ -134,7 +185,39 @@ func loadConfig() *AppConfig {
 		if err == nil && cleanupInterval > 0 {
 			cfg.CleanupIntervalSeconds = cleanupInterval
 		} else {
-			logger.Printf("Invalid %s value '%s', using default %d second(s)", envCleanupInterval, cleanupIntervalStr, defaultCleanupInterval)
+			logger.Warn("Invalid value, using default", "env", envCleanupInterval, "value", cleanupIntervalStr, "default", defaultCleanupInterval)
+		}
+	}
+	if shutdownTimeoutStr := os.Getenv(envShutdownTimeout); shutdownTimeoutStr != "" {
+		shutdownTimeout, err := strconv.ParseInt(shutdownTimeoutStr, 10, 64)
+		if err == nil && shutdownTimeout >= 0 {
+			cfg.ShutdownTimeoutSeconds = shutdownTimeout
+		} else {
+			logger.Warn("Invalid value, using default", "env", envShutdownTimeout, "value", shutdownTimeoutStr, "default", defaultShutdownTimeout)
+		}
+	}
+	if maxDownloadsStr := os.Getenv(envMaxDownloadsLimit); maxDownloadsStr != "" {
+		maxDownloads, err := strconv.ParseInt(maxDownloadsStr, 10, 64)
+		if err == nil && maxDownloads >= 0 {
+			cfg.MaxDownloadsLimit = maxDownloads
+		} else {
+			logger.Warn("Invalid value, downloads per upload are not capped", "env", envMaxDownloadsLimit, "value", maxDownloadsStr)
+		}
+	}
+	if dedupStr := os.Getenv(envDedup); dedupStr != "" {
+		dedup, err := strconv.ParseBool(dedupStr)
+		if err == nil {
+			cfg.Dedup = dedup
+		} else {
+			logger.Warn("Invalid value, deduplication stays disabled", "env", envDedup, "value", dedupStr)
+		}
+	}
+	if minFreeStr := os.Getenv(envMinFreeSpace); minFreeStr != "" {
+		minFree, err := strconv.ParseInt(minFreeStr, 10, 64)
+		if err == nil && minFree >= 0 {
+			cfg.MinFreeSpace = minFree
+		} else {
+			logger.Warn("Invalid value, using default", "env", envMinFreeSpace, "value", minFreeStr, "default", defaultMinFreeSpace)
 		}
 	}
 	if proxyStr := os.Getenv(envTrustedProxies); proxyStr != "" {
@@ -142,18 +225,16 @@ func loadConfig() *AppConfig {
 		validProxies := make([]string, 0, len(proxies))
 		for _, p := range proxies {
 			trimmed := strings.TrimSpace(p)
-			if _, _, err := net.ParseCIDR(trimmed); err == nil {
-				validProxies = append(validProxies, trimmed)
-			} else if ip := net.ParseIP(trimmed); ip != nil {
+			if validTrustedProxy(trimmed) {
 				validProxies = append(validProxies, trimmed)
 			} else if trimmed != "" {
-				logger.Printf("Invalid proxy format in TRUSTED_PROXIES: %s", trimmed)
+				logger.Warn("Invalid proxy format, ignoring it", "env", envTrustedProxies, "value", trimmed)
 			}
 		}
 		if len(validProxies) > 0 {
 			cfg.TrustedProxies = validProxies
 		} else {
-			logger.Println("No valid proxies found in TRUSTED_PROXIES, using default.")
+			logger.Warn("No valid proxies found, using default", "env", envTrustedProxies)
 		}
 	}
 	if st := os.Getenv(envStorageType); st != "" {
@@ -161,12 +242,42 @@ func loadConfig() *AppConfig {
 		if st == string(StorageLocal) || st == string(StorageR2) {
 			cfg.StorageType = StorageType(st)
 		} else {
-			logger.Printf("Invalid STORAGE_TYPE '%s', using default 'local'", st)
+			logger.Warn("Invalid value, using default", "env", envStorageType, "value", st, "default", StorageLocal)
 		}
 	}
 	cfg.R2AccountID = os.Getenv(envR2AccountID)
 	cfg.R2AccessKeyID = os.Getenv(envR2AccessKeyID)
 	cfg.R2SecretAccessKey = os.Getenv(envR2SecretAccessKey)
 	cfg.R2BucketName = os.Getenv(envR2BucketName)
+	cfg.AdminToken = os.Getenv(envAdminToken)
+	if cfg.AdminToken == "" && os.Getenv(envConfigAPIPassword) != "" {
+		logger.Warn("Deprecated setting, use "+envAdminToken+" for the admin API", "env", envConfigAPIPassword)
+		cfg.AdminToken = os.Getenv(envConfigAPIPassword)
+	}
+	cfg.SigningSecret = os.Getenv(envSigningSecret)
+	if signedOnlyStr := os.Getenv(envSignedOnly); signedOnlyStr != "" {
+		signedOnly, err := strconv.ParseBool(signedOnlyStr)
+		if err != nil {
+			logger.Warn("Invalid value, signed-only mode stays disabled", "env", envSignedOnly, "value", signedOnlyStr)
+		} else if signedOnly && cfg.SigningSecret == "" {
+			logger.Warn("Signed-only mode requires "+envSigningSecret+", it stays disabled", "env", envSignedOnly)
+		} else {
+			cfg.SignedOnly = signedOnly
+		}
+	}
+	keys, err := loadAPIKeys(os.Getenv(envAPIKeysFile), os.Getenv(envAPIKeys))
+	if err != nil {
+		// Falling back to open uploads would silently drop the protection.
+		fatal("Failed to load API keys", "error", err)
+	}
+	cfg.APIKeys = keys
 	return cfg
 }
+
+// validTrustedProxy reports whether proxy is an IP address or CIDR range.
+func validTrustedProxy(proxy string) bool {
+	if _, _, err := net.ParseCIDR(proxy); err == nil {
+		return true
+	}
+	return net.ParseIP(proxy) != nil
+}
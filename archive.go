@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+// handleArchiveDownload answers GET /:random_id/?archive=zip|tar.gz by streaming
+// every file under the ID into one archive. Nothing is staged on disk, so the
+// archive is refused up front if its content would exceed MaxArchiveSize.
+func handleArchiveDownload(c *gin.Context, randomID, format string) {
+	if format != archiveZip && format != archiveTarGz {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("Unsupported archive format %q, use %s or %s", format, archiveZip, archiveTarGz), nil)
+		return
+	}
+	meta, objects, ok := listUploadFiles(c, randomID, false)
+	if !ok {
+		return
+	}
+	if meta != nil {
+		for _, file := range meta.Files {
+			if file.encrypted() {
+				abortWithError(c, http.StatusBadRequest, "Uploads with encrypted files cannot be downloaded as an archive", nil)
+				return
+			}
+		}
+	}
+	var totalSize int64
+	for _, obj := range objects {
+		totalSize += obj.Size
+	}
+	if totalSize > currentConfig().MaxArchiveSize {
+		abortWithError(c, http.StatusForbidden,
+			fmt.Sprintf("Files under %s total %d bytes, more than the maximum archive size (%d bytes)", randomID, totalSize, currentConfig().MaxArchiveSize), nil)
+		return
+	}
+	if _, err := countDownload(c.Request.Context(), randomID); errors.Is(err, errUploadExpired) || errors.Is(err, errDownloadLimitReached) {
+		abortWithError(c, http.StatusGone, "Files are no longer available", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+
+	archiveName := randomID + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveName))
+	c.Header("Cache-Control", "no-store")
+	var err error
+	if format == archiveZip {
+		c.Header("Content-Type", "application/zip")
+		c.Status(http.StatusOK)
+		err = writeZipArchive(c, randomID, objects)
+	} else {
+		c.Header("Content-Type", "application/gzip")
+		c.Status(http.StatusOK)
+		err = writeTarGzArchive(c, randomID, objects)
+	}
+	if err != nil {
+		// The status line is already sent, so the best we can do is cut the
+		// stream short and let the client see a truncated archive.
+		requestLogger(c).Error("Archive failed after headers were sent", "archive", archiveName, "ip", c.ClientIP(), "error", err)
+		c.Abort()
+		return
+	}
+	requestLogger(c).Info("Archive served", "archive", archiveName, "files", len(objects), "bytes", totalSize)
+}
+
+func writeZipArchive(c *gin.Context, randomID string, objects []ObjectInfo) error {
+	zw := zip.NewWriter(c.Writer)
+	for _, obj := range objects {
+		header := &zip.FileHeader{
+			Name:     strings.TrimPrefix(obj.Key, randomID+"/"),
+			Method:   zip.Deflate,
+			Modified: obj.ModTime,
+		}
+		header.SetMode(0644)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyArchiveEntry(c, w, obj); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGzArchive(c *gin.Context, randomID string, objects []ObjectInfo) error {
+	gw := gzip.NewWriter(c.Writer)
+	tw := tar.NewWriter(gw)
+	for _, obj := range objects {
+		header := &tar.Header{
+			Name:    strings.TrimPrefix(obj.Key, randomID+"/"),
+			Mode:    0644,
+			Size:    obj.Size,
+			ModTime: obj.ModTime,
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyArchiveEntry(c, tw, obj); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyArchiveEntry writes at most obj.Size bytes of obj to w, so the archive
+// cannot outgrow the size checked before streaming started.
+func copyArchiveEntry(c *gin.Context, w io.Writer, obj ObjectInfo) error {
+	content, _, err := store.Get(c.Request.Context(), obj.Key)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", obj.Key, err)
+	}
+	defer content.Close()
+	buf := make([]byte, bufferSize)
+	if _, err := io.CopyBuffer(w, io.LimitReader(content, obj.Size), buf); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", obj.Key, err)
+	}
+	return nil
+}
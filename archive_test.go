@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// readTestArchive returns the entries of a zip or tar.gz archive by name.
+func readTestArchive(t *testing.T, format string, data []byte) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	if format == archiveZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			entries[f.Name] = string(content)
+		}
+		return entries
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		entries[header.Name] = string(content)
+	}
+}
+
+func TestArchiveDownload(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "a.txt", "hello", nil)
+	if w := serveRequest(r, http.MethodPut, "/"+upload.ID+"/docs/b.txt", map[string]string{deleteTokenHeader: upload.DeleteToken}, "hello again"); w.Code != http.StatusCreated {
+		t.Fatalf("adding a file: status %d, body %s", w.Code, w.Body)
+	}
+
+	for _, format := range []string{archiveZip, archiveTarGz} {
+		w := serveRequest(r, http.MethodGet, "/"+upload.ID+"/?archive="+format, nil, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, body %s", format, w.Code, w.Body)
+		}
+		if want := `attachment; filename="` + upload.ID + "." + format + `"`; w.Header().Get("Content-Disposition") != want {
+			t.Errorf("%s: Content-Disposition %q, want %q", format, w.Header().Get("Content-Disposition"), want)
+		}
+		entries := readTestArchive(t, format, w.Body.Bytes())
+		if len(entries) != 2 || entries["a.txt"] != "hello" || entries["docs/b.txt"] != "hello again" {
+			t.Errorf("%s: entries %v", format, entries)
+		}
+	}
+}
+
+func TestArchiveDownloadRefusals(t *testing.T) {
+	useMemoryStorage(t)
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxArchiveSize = 10 })
+	r := newTestRouter(t)
+	small := putTestFile(t, r, "a.txt", "hello", map[string]string{maxDownloadsHeader: "1"})
+	large := putTestFile(t, r, "a.txt", "hello world", nil)
+	encrypted := putTestFile(t, r, "a.txt", "hello", map[string]string{encryptHeader: "1"})
+
+	steps := []struct {
+		name, target string
+		wantStatus   int
+	}{
+		{"unsupported format", "/" + small.ID + "/?archive=rar", http.StatusBadRequest},
+		{"beyond the maximum archive size", "/" + large.ID + "/?archive=zip", http.StatusForbidden},
+		{"encrypted files", "/" + encrypted.ID + "/?archive=zip", http.StatusBadRequest},
+		{"unknown ID", "/mnopqrstuvwx/?archive=zip", http.StatusNotFound},
+		{"archive", "/" + small.ID + "/?archive=tar.gz", http.StatusOK},
+		{"archive counted as a download", "/" + small.ID + "/?archive=tar.gz", http.StatusGone},
+		{"file after the archive", small.path, http.StatusGone},
+	}
+	for _, step := range steps {
+		if w := serveRequest(r, http.MethodGet, step.target, nil, ""); w.Code != step.wantStatus {
+			t.Errorf("%s: status %d, want %d", step.name, w.Code, step.wantStatus)
+		}
+	}
+}
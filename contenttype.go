@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const sniffLength = 512
+
+// inlineContentTypes are served as-is with ?inline=1. Any other text/* type is
+// downgraded to text/plain, and everything else is always sent as an attachment.
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"image/avif":      true,
+	"application/pdf": true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wave":      true,
+	"audio/webm":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+}
+
+// activeTextTypes can run script or load resources when rendered, so they are
+// never shown inline even though they are text.
+var activeTextTypes = map[string]bool{
+	"text/html":       true,
+	"text/xml":        true,
+	"text/css":        true,
+	"text/javascript": true,
+}
+
+// inlineCSP sandboxes inline content so a file cannot run script against this origin.
+const inlineCSP = "sandbox; default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'"
+
+// sniffContentType detects the type of r from its first bytes and the filename
+// extension. The returned reader yields the full content, including the sniffed bytes.
+func sniffContentType(r io.Reader, filename string) (string, io.Reader, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return detectContentType(filename, head), io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+func detectContentType(filename string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") {
+		if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExt != "" {
+			return byExt
+		}
+	}
+	return sniffed
+}
+
+// inlineContentType returns the Content-Type to send when contentType is shown
+// inline, and false if it must be downloaded instead.
+func inlineContentType(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	if inlineContentTypes[mediaType] {
+		return mediaType, true
+	}
+	if strings.HasPrefix(mediaType, "text/") && !activeTextTypes[mediaType] {
+		return "text/plain; charset=utf-8", true
+	}
+	return "", false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testPNG = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		filename, head, want string
+	}{
+		{"photo.bin", testPNG, "image/png"},
+		{"report", "%PDF-1.4", "application/pdf"},
+		{"page.txt", "<!DOCTYPE html><html>", "text/html; charset=utf-8"},
+		{"drawing.svg", `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, "image/svg+xml"},
+		{"notes.txt", "hello", "text/plain; charset=utf-8"},
+		{"data.bin", "\x00\x01\x02\x03", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := detectContentType(tt.filename, []byte(tt.head)); got != tt.want {
+			t.Errorf("detectContentType(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestInlineContentType(t *testing.T) {
+	tests := []struct {
+		contentType, want string
+		wantOK            bool
+	}{
+		{"image/png", "image/png", true},
+		{"application/pdf", "application/pdf", true},
+		{"text/plain; charset=utf-8", "text/plain; charset=utf-8", true},
+		{"text/csv", "text/plain; charset=utf-8", true},
+		{"text/html; charset=utf-8", "", false},
+		{"image/svg+xml", "", false},
+		{"application/octet-stream", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := inlineContentType(tt.contentType); got != tt.want || ok != tt.wantOK {
+			t.Errorf("inlineContentType(%q) = %q, %v, want %q, %v", tt.contentType, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestInlineDownload(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	image := putTestFile(t, r, "photo.png", testPNG, nil)
+	page := putTestFile(t, r, "page.html", "<!DOCTYPE html><script>alert(1)</script>", nil)
+
+	tests := []struct {
+		name, target, wantType, wantDisposition string
+		wantSandbox                             bool
+	}{
+		{"image", image.path, "application/octet-stream", "attachment", false},
+		{"inline image", image.path + "?inline=1", "image/png", "inline", true},
+		{"inline HTML", page.path + "?inline=1", "application/octet-stream", "attachment", false},
+	}
+	for _, tt := range tests {
+		w := serveRequest(r, http.MethodGet, tt.target, nil, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.name, w.Code)
+		}
+		header := w.Header()
+		if header.Get("Content-Type") != tt.wantType || !strings.HasPrefix(header.Get("Content-Disposition"), tt.wantDisposition+";") || (header.Get("Content-Security-Policy") == inlineCSP) != tt.wantSandbox {
+			t.Errorf("%s: Content-Type %q, Content-Disposition %q, CSP %q", tt.name, header.Get("Content-Type"), header.Get("Content-Disposition"), header.Get("Content-Security-Policy"))
+		}
+	}
+}
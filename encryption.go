@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted uploads are stored as encryptionMagic followed by AES-256-GCM
+// sealed chunks of up to encryptedChunkSize plaintext bytes. Each nonce is the
+// chunk index plus a flag marking the final chunk, so chunks cannot be
+// reordered or the file truncated without decryption failing. Every file gets
+// a fresh random key, which only ever appears in its download URL.
+
+const (
+	encryptionKeySize  = 32
+	encryptedChunkSize = 64 << 10
+	encryptionMagic    = "XTE1"
+	// encryptionKeySeparator joins the random ID and hex key in the first
+	// path segment of an encrypted file's URL: /<random_id>_<key>/<filepath>.
+	encryptionKeySeparator = "_"
+)
+
+var errDecryptionFailed = errors.New("decryption failed: wrong key or corrupted data")
+
+func generateEncryptionKey() ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// hashEncryptionKey returns what the upload record keeps of a key: enough to
+// reject a wrong key before streaming, not enough to decrypt anything.
+func hashEncryptionKey(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkEncryptionKey reports whether key matches the hash recorded for file.
+func (file *fileMetadata) checkEncryptionKey(key []byte) bool {
+	if len(key) != encryptionKeySize {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashEncryptionKey(key)), []byte(file.KeyHash)) == 1
+}
+
+// splitEncryptionKey separates the random ID from the hex key in the first
+// path segment of a download URL. key is nil if the segment carries none.
+func splitEncryptionKey(segment string) (randomID string, key []byte, err error) {
+	randomID, hexKey, found := strings.Cut(segment, encryptionKeySeparator)
+	if !found {
+		return randomID, nil, nil
+	}
+	key, err = hex.DecodeString(hexKey)
+	if err != nil || len(key) != encryptionKeySize {
+		return randomID, nil, errors.New("malformed encryption key")
+	}
+	return randomID, key, nil
+}
+
+func newChunkAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(nonce []byte, index uint64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], index)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingReader yields the encrypted form of src.
+type encryptingReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	index   uint64
+	plain   []byte
+	carried int
+	sealed  []byte
+	out     []byte
+	done    bool
+}
+
+func newEncryptingReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{
+		src:   src,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		// One byte more than a chunk, to tell whether another chunk follows.
+		plain:  make([]byte, encryptedChunkSize+1),
+		sealed: make([]byte, 0, encryptedChunkSize+aead.Overhead()),
+		out:    []byte(encryptionMagic),
+	}, nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.plain[r.carried:])
+		n += r.carried
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		chunk := r.plain[:min(n, encryptedChunkSize)]
+		r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.nonce, r.index, last), chunk, nil)
+		r.out = r.sealed
+		r.index++
+		r.done = last
+		r.carried = 0
+		if !last {
+			r.plain[0] = r.plain[encryptedChunkSize]
+			r.carried = 1
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptingReader yields the plaintext of a stream written by encryptingReader.
+// It fails with errDecryptionFailed on a wrong key or any tampering.
+type decryptingReader struct {
+	src      io.Reader
+	aead     cipher.AEAD
+	nonce    []byte
+	index    uint64
+	sealed   []byte
+	carried  int
+	plain    []byte
+	out      []byte
+	started  bool
+	done     bool
+	chunkErr error
+}
+
+func newDecryptingReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		src:    src,
+		aead:   aead,
+		nonce:  make([]byte, aead.NonceSize()),
+		sealed: make([]byte, encryptedChunkSize+aead.Overhead()+1),
+		plain:  make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.chunkErr != nil {
+		return 0, r.chunkErr
+	}
+	if !r.started {
+		magic := make([]byte, len(encryptionMagic))
+		if _, err := io.ReadFull(r.src, magic); err != nil || string(magic) != encryptionMagic {
+			r.chunkErr = errDecryptionFailed
+			return 0, r.chunkErr
+		}
+		r.started = true
+	}
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunkLen := encryptedChunkSize + r.aead.Overhead()
+		n, err := io.ReadFull(r.src, r.sealed[r.carried:])
+		n += r.carried
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		plain, openErr := r.aead.Open(r.plain[:0], chunkNonce(r.nonce, r.index, last), r.sealed[:min(n, chunkLen)], nil)
+		if openErr != nil {
+			r.chunkErr = errDecryptionFailed
+			return 0, r.chunkErr
+		}
+		r.plain = plain
+		r.out = plain
+		r.index++
+		r.done = last
+		r.carried = 0
+		if !last {
+			r.sealed[0] = r.sealed[chunkLen]
+			r.carried = 1
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
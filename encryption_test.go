@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// encryptForTest returns the encrypted form of plaintext under key.
+func encryptForTest(t *testing.T, plaintext, key []byte) []byte {
+	t.Helper()
+	r, err := newEncryptingReader(bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func decryptForTest(sealed, key []byte) ([]byte, error) {
+	r, err := newDecryptingReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := generateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	const overhead = 16
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		sealed := encryptForTest(t, plaintext, key)
+
+		chunks := max(1, (size+encryptedChunkSize-1)/encryptedChunkSize)
+		if want := len(encryptionMagic) + size + chunks*overhead; len(sealed) != want {
+			t.Errorf("size %d: encrypted to %d bytes, want %d", size, len(sealed), want)
+		}
+		if !bytes.HasPrefix(sealed, []byte(encryptionMagic)) {
+			t.Errorf("size %d: encrypted stream does not start with %q", size, encryptionMagic)
+		}
+		decrypted, err := decryptForTest(sealed, key)
+		if err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: decrypted content differs from plaintext", size)
+		}
+	}
+}
+
+func TestDecryptionDetectsTampering(t *testing.T) {
+	key := newTestKey(t)
+	plaintext := make([]byte, 2*encryptedChunkSize+10)
+	rand.Read(plaintext)
+	sealed := encryptForTest(t, plaintext, key)
+	chunkLen := encryptedChunkSize + 16
+	first := len(encryptionMagic)
+
+	tests := []struct {
+		name   string
+		sealed func() []byte
+		key    []byte
+	}{
+		{"wrong key", func() []byte { return sealed }, newTestKey(t)},
+		{"bad magic", func() []byte {
+			tampered := bytes.Clone(sealed)
+			tampered[0] ^= 1
+			return tampered
+		}, key},
+		{"flipped byte", func() []byte {
+			tampered := bytes.Clone(sealed)
+			tampered[first+chunkLen+100] ^= 1
+			return tampered
+		}, key},
+		{"truncated at chunk boundary", func() []byte {
+			return bytes.Clone(sealed[:first+2*chunkLen])
+		}, key},
+		{"truncated inside chunk", func() []byte {
+			return bytes.Clone(sealed[:len(sealed)-1])
+		}, key},
+		{"reordered chunks", func() []byte {
+			tampered := bytes.Clone(sealed)
+			copy(tampered[first:], sealed[first+chunkLen:first+2*chunkLen])
+			copy(tampered[first+chunkLen:], sealed[first:first+chunkLen])
+			return tampered
+		}, key},
+		{"appended chunk", func() []byte {
+			return append(bytes.Clone(sealed), sealed[first:first+chunkLen]...)
+		}, key},
+		{"empty", func() []byte { return nil }, key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decryptForTest(tt.sealed(), tt.key); !errors.Is(err, errDecryptionFailed) {
+				t.Errorf("decrypt error = %v, want %v", err, errDecryptionFailed)
+			}
+		})
+	}
+}
+
+func TestSplitEncryptionKey(t *testing.T) {
+	key := newTestKey(t)
+	segment := "abcdefghijkl" + encryptionKeySeparator + hex.EncodeToString(key)
+	randomID, got, err := splitEncryptionKey(segment)
+	if err != nil || randomID != "abcdefghijkl" || !bytes.Equal(got, key) {
+		t.Errorf("splitEncryptionKey(%q) = %q, %x, %v", segment, randomID, got, err)
+	}
+	if _, got, err := splitEncryptionKey("abcdefghijkl"); err != nil || got != nil {
+		t.Errorf("segment without key: got key %x, error %v", got, err)
+	}
+	for _, segment := range []string{"abcdefghijkl_zz", "abcdefghijkl_0011"} {
+		if _, _, err := splitEncryptionKey(segment); err == nil {
+			t.Errorf("splitEncryptionKey(%q) accepted a malformed key", segment)
+		}
+	}
+}
+
+func TestEncryptedFileInfoNeedsKey(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "secret.pdf", "%PDF-1.4", map[string]string{encryptHeader: "1"})
+	withoutKey := "/" + upload.ID + "/secret.pdf"
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"info with the key", upload.path + "?info", "application/pdf"},
+		{"info without the key", withoutKey + "?info", ""},
+		{"info with a wrong key", "/" + upload.ID + encryptionKeySeparator + hex.EncodeToString(newTestKey(t)) + "/secret.pdf?info", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveRequest(r, http.MethodGet, tt.target, nil, "")
+			var info struct {
+				OriginalFilename string `json:"original_filename"`
+				ContentType      string `json:"content_type"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("status %d, body %s", w.Code, w.Body)
+			}
+			if info.ContentType != tt.want || (info.OriginalFilename != "") != (tt.want != "") {
+				t.Errorf("original_filename %q, content_type %q, want them shown: %v", info.OriginalFilename, info.ContentType, tt.want != "")
+			}
+		})
+	}
+
+	w := serveRequest(r, http.MethodGet, "/"+upload.ID+"/", map[string]string{"Accept": "application/json"}, "")
+	if strings.Contains(w.Body.String(), "application/pdf") {
+		t.Errorf("listing shows the content type of an encrypted file: %s", w.Body)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxExtractEntries caps the number of files one archive may expand into.
+	maxExtractEntries = 10000
+	// maxCompressionRatio caps expanded bytes per archive byte once more than
+	// compressionRatioSlack bytes have been expanded, so small, highly
+	// compressible archives are still accepted.
+	maxCompressionRatio   = 100
+	compressionRatioSlack = 1 << 20
+)
+
+var (
+	errTooManyEntries      = errors.New("archive has too many entries")
+	errExpandedTooLarge    = errors.New("archive expands beyond the maximum archive size")
+	errCompressionTooHigh  = errors.New("archive compression ratio is too high")
+	errUnsupportedArchive  = errors.New("unsupported archive format")
+	errArchiveEntryInvalid = errors.New("archive entry has an invalid name")
+)
+
+// extractFormat returns the archive format of filename, or "" if it is not an
+// archive that can be extracted.
+func extractFormat(filename string) string {
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	}
+	return ""
+}
+
+// extractBudget enforces the limits shared by every entry of one archive.
+type extractBudget struct {
+	entries  int
+	expanded int64
+	// compressed reports how many archive bytes have been consumed so far.
+	compressed func() int64
+	err        error
+}
+
+// entry accounts for one more file and returns a reader that charges its bytes
+// to the budget.
+func (b *extractBudget) entry(r io.Reader) (io.Reader, error) {
+	b.entries++
+	if b.entries > maxExtractEntries {
+		b.err = errTooManyEntries
+		return nil, b.err
+	}
+	return &budgetReader{r: r, budget: b}, nil
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *extractBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	b := r.budget
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := r.r.Read(p)
+	b.expanded += int64(n)
+	if b.expanded > currentConfig().MaxArchiveSize {
+		b.err = errExpandedTooLarge
+	} else if b.expanded > compressionRatioSlack && b.expanded > maxCompressionRatio*b.compressed() {
+		b.err = errCompressionTooHigh
+	}
+	if b.err != nil {
+		return n, b.err
+	}
+	return n, err
+}
+
+// extractUploadedArchive stores every regular file of the uploaded archive under
+// randomID in place of the archive itself. Entry names go through the same
+// checks as uploaded filenames. On failure it responds to the client itself and
+// returns false; files already stored are left for the caller to remove.
+func extractUploadedArchive(c *gin.Context, randomID string, source uploadSource, format string, uploadedAt time.Time) ([]fileMetadata, bool) {
+	body, err := source.open()
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Failed to read upload body", err)
+		return nil, false
+	}
+	defer body.Close()
+	sizeLimit := uploadSizeLimit(c.Request.Context())
+	limitedReader := newSizeLimitedReader(body, sizeLimit)
+	counter := &countingReader{r: limitedReader}
+	budget := &extractBudget{compressed: func() int64 { return counter.n }}
+	var files []fileMetadata
+	storeEntry := func(name string, r io.Reader) error {
+		entry, err := budget.entry(r)
+		if err != nil {
+			return err
+		}
+		if _, err := getSanitizedUserPath(name); err != nil {
+			return fmt.Errorf("%w %q: %v", errArchiveEntryInvalid, name, err)
+		}
+		file, err := putUploadedFile(c.Request.Context(), randomID, name, entry, uploadedAt, fileChecksums{}, source.encrypt)
+		if budget.err != nil {
+			return budget.err
+		}
+		if err != nil {
+			return err
+		}
+		files = mergeFiles(files, []fileMetadata{*file})
+		return nil
+	}
+
+	switch format {
+	case archiveTar, archiveTarGz:
+		err = extractTar(counter, format == archiveTarGz, storeEntry)
+	case archiveZip:
+		err = extractZip(counter, storeEntry)
+	default:
+		err = errUnsupportedArchive
+	}
+	if limitedReader.exceeded {
+		abortWithError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Uploaded file %s exceeds maximum allowed size (%d bytes)", source.filename, sizeLimit), err)
+		return nil, false
+	}
+	if err != nil {
+		var uploadErr *uploadError
+		switch {
+		case errors.Is(err, errTooManyEntries), errors.Is(err, errExpandedTooLarge), errors.Is(err, errCompressionTooHigh):
+			abortWithError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Refusing to extract %s", source.filename), err)
+		case errors.As(err, &uploadErr):
+			abortWithUploadError(c, err)
+		default:
+			abortWithError(c, http.StatusBadRequest, fmt.Sprintf("Failed to extract %s", source.filename), err)
+		}
+		return nil, false
+	}
+	if len(files) == 0 {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("Archive %s contains no files", source.filename), nil)
+		return nil, false
+	}
+	requestLogger(c).Info("Archive extracted", "id", randomID, "archive", source.filename, "files", len(files), "bytes", budget.expanded)
+	return files, true
+}
+
+// extractTar calls storeEntry for every regular file in a tar stream. Links,
+// devices and other special entries are skipped.
+func extractTar(r io.Reader, gzipped bool, storeEntry func(name string, r io.Reader) error) error {
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := storeEntry(header.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip spools a zip archive to a temporary file, since its directory sits
+// at the end, and calls storeEntry for every regular file in it.
+func extractZip(r io.Reader, storeEntry func(name string, r io.Reader) error) error {
+	spool, err := os.CreateTemp("", "xtemp-extract-*.zip")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	buf := make([]byte, bufferSize)
+	size, err := io.CopyBuffer(spool, r, buf)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if err := extractZipEntry(f, storeEntry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipEntry(f *zip.File, storeEntry func(name string, r io.Reader) error) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return storeEntry(f.Name, rc)
+}
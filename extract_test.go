@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readEntry charges content to budget as one archive entry and reads it all.
+func readEntry(budget *extractBudget, content io.Reader) error {
+	entry, err := budget.entry(content)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, entry)
+	return err
+}
+
+func unlimitedCompressed() int64 {
+	return 1 << 40
+}
+
+func TestExtractBudgetLimitsEntries(t *testing.T) {
+	budget := &extractBudget{compressed: unlimitedCompressed}
+	for i := 0; i < maxExtractEntries; i++ {
+		if err := readEntry(budget, strings.NewReader("x")); err != nil {
+			t.Fatalf("entry %d: %v", i+1, err)
+		}
+	}
+	if err := readEntry(budget, strings.NewReader("x")); !errors.Is(err, errTooManyEntries) {
+		t.Errorf("entry %d: error = %v, want %v", maxExtractEntries+1, err, errTooManyEntries)
+	}
+}
+
+func TestExtractBudgetLimitsExpandedSize(t *testing.T) {
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxArchiveSize = 1000 })
+	budget := &extractBudget{compressed: unlimitedCompressed}
+	if err := readEntry(budget, bytes.NewReader(make([]byte, 600))); err != nil {
+		t.Fatalf("first entry: %v", err)
+	}
+	// The limit applies to the archive as a whole, not to each entry.
+	if err := readEntry(budget, bytes.NewReader(make([]byte, 600))); !errors.Is(err, errExpandedTooLarge) {
+		t.Errorf("second entry: error = %v, want %v", err, errExpandedTooLarge)
+	}
+	if err := readEntry(budget, strings.NewReader("x")); !errors.Is(err, errExpandedTooLarge) {
+		t.Errorf("entry after the limit was hit: error = %v, want %v", err, errExpandedTooLarge)
+	}
+}
+
+func TestExtractBudgetLimitsCompressionRatio(t *testing.T) {
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxArchiveSize = 1 << 30 })
+	compressed := func() int64 { return 1000 }
+
+	budget := &extractBudget{compressed: compressed}
+	if err := readEntry(budget, bytes.NewReader(make([]byte, compressionRatioSlack))); err != nil {
+		t.Errorf("expanding to the slack: %v", err)
+	}
+	budget = &extractBudget{compressed: compressed}
+	if err := readEntry(budget, bytes.NewReader(make([]byte, compressionRatioSlack+1))); !errors.Is(err, errCompressionTooHigh) {
+		t.Errorf("expanding past the slack: error = %v, want %v", err, errCompressionTooHigh)
+	}
+	budget = &extractBudget{compressed: func() int64 { return 2*compressionRatioSlack/maxCompressionRatio + 1 }}
+	if err := readEntry(budget, bytes.NewReader(make([]byte, 2*compressionRatioSlack))); err != nil {
+		t.Errorf("expanding at the maximum ratio: %v", err)
+	}
+}
+
+// tarGzForTest builds a gzipped tar holding files, plus a symlink that
+// extraction must skip.
+func tarGzForTest(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractTarGzForTest extracts archive under a fresh budget, the way uploads
+// are extracted, and returns the size of every stored entry.
+func extractTarGzForTest(archive []byte) (map[string]int64, error) {
+	counter := &countingReader{r: bytes.NewReader(archive)}
+	budget := &extractBudget{compressed: func() int64 { return counter.n }}
+	stored := make(map[string]int64)
+	err := extractTar(counter, true, func(name string, r io.Reader) error {
+		entry, err := budget.entry(r)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.Discard, entry)
+		stored[name] = n
+		return err
+	})
+	return stored, err
+}
+
+func TestExtractTar(t *testing.T) {
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxArchiveSize = 1 << 30 })
+	random := make([]byte, 4096)
+	rand.Read(random)
+	stored, err := extractTarGzForTest(tarGzForTest(t, map[string][]byte{"a.txt": []byte("hello"), "dir/b.bin": random}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored["a.txt"] != 5 || stored["dir/b.bin"] != 4096 {
+		t.Errorf("stored %v, want a.txt with 5 bytes and dir/b.bin with 4096", stored)
+	}
+}
+
+func TestExtractTarRefusesArchiveBomb(t *testing.T) {
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxArchiveSize = 1 << 30 })
+	archive := tarGzForTest(t, map[string][]byte{"zeros": make([]byte, 8*compressionRatioSlack)})
+	if _, err := extractTarGzForTest(archive); !errors.Is(err, errCompressionTooHigh) {
+		t.Errorf("error = %v, want %v", err, errCompressionTooHigh)
+	}
+
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxArchiveSize = compressionRatioSlack / 2 })
+	if _, err := extractTarGzForTest(archive); !errors.Is(err, errExpandedTooLarge) {
+		t.Errorf("with a small maximum archive size: error = %v, want %v", err, errExpandedTooLarge)
+	}
+}
+
+func TestExtractFormat(t *testing.T) {
+	for filename, want := range map[string]string{
+		"photos.tar.gz": archiveTarGz,
+		"photos.TGZ":    archiveTarGz,
+		"photos.tar":    archiveTar,
+		"photos.zip":    archiveZip,
+		"photos.gz":     "",
+		"photos.txt":    "",
+	} {
+		if got := extractFormat(filename); got != want {
+			t.Errorf("extractFormat(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
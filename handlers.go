@@ -1,149 +1,909 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 )
 
-func commonUploadLogic(c *gin.Context, filename string, bodyReader io.Reader, isPut bool) {
-	randomID := generateUniqueID()
-	sanitizedFilename, err := getSanitizedUserPath(filename)
+// multipartOverhead is what a multipart POST may carry besides its files:
+// boundaries, part headers and form fields.
+const multipartOverhead = 1 << 20
+
+// uploadSource is one file of an upload request.
+type uploadSource struct {
+	filename string
+	open     func() (io.ReadCloser, error)
+	// expected holds checksums the uploader asked the stored file to match.
+	expected fileChecksums
+	// encrypt stores the file encrypted under a fresh key returned in its URL.
+	encrypt bool
+}
+
+var errChecksumMismatch = errors.New("checksum does not match")
+
+// verifiedReader reads r and runs verify once r is exhausted. An error from
+// verify is returned in place of io.EOF.
+type verifiedReader struct {
+	r      io.Reader
+	verify func() error
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err == io.EOF {
+		if verifyErr := v.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+// fileChecksums are lowercase hex digests; empty fields are not checked.
+type fileChecksums struct {
+	SHA256 string
+	MD5    string
+}
+
+// commonUploadLogic stores every source under one new random ID and responds
+// with a link per file.
+func commonUploadLogic(c *gin.Context, sources []uploadSource, isPut bool) {
+	options, err := parseUploadOptions(c)
 	if err != nil {
-		abortWithError(c, http.StatusBadRequest, "Invalid filename provided", err)
+		abortWithError(c, http.StatusBadRequest, "Invalid upload options", err)
 		return
 	}
-	fullStoragePath, _, err := buildAndVerifyStoragePath(randomID, sanitizedFilename)
-	if err != nil {
-		abortWithError(c, http.StatusInternalServerError, "Failed to prepare storage path", err)
+	if !checkUploadFilenames(c, sources) {
 		return
 	}
-	limitedReader := io.LimitedReader{R: bodyReader, N: config.MaxUploadSize + 1}
-	bytesWritten, err := saveFileContent(fullStoragePath, &limitedReader)
+	randomID := generateUniqueID()
+	files := make([]fileMetadata, 0, len(sources))
+	for _, source := range sources {
+		if format := extractFormat(source.filename); options.extract && format != "" {
+			if source.expected != (fileChecksums{}) {
+				discardUpload(c, randomID)
+				abortWithError(c, http.StatusBadRequest, "Expected checksums cannot be combined with archive extraction", nil)
+				return
+			}
+			extracted, ok := extractUploadedArchive(c, randomID, source, format, options.createdAt)
+			if !ok {
+				discardUpload(c, randomID)
+				return
+			}
+			files = mergeFiles(files, extracted)
+			continue
+		}
+		file, ok := storeUploadedFile(c, randomID, source, options.createdAt)
+		if !ok {
+			discardUpload(c, randomID)
+			return
+		}
+		files = mergeFiles(files, []fileMetadata{*file})
+	}
+	deleteToken, err := generateDeleteToken()
+	meta := &uploadMetadata{
+		ID:              randomID,
+		DeleteTokenHash: hashDeleteToken(deleteToken),
+		UploaderIP:      c.ClientIP(),
+		APIKey:          uploadKeyName(c.Request.Context()),
+		CreatedAt:       options.createdAt,
+		ExpiresAt:       options.expiresAt,
+		MaxDownloads:    options.maxDownloads,
+		PasswordHash:    options.passwordHash,
+		Files:           recordedFiles(files),
+	}
+	if err == nil {
+		err = saveMetadata(c.Request.Context(), meta)
+	}
 	if err != nil {
-		abortWithError(c, http.StatusInternalServerError, "Failed to save file", err)
+		discardUpload(c, randomID)
+		abortWithError(c, http.StatusInternalServerError, "Failed to record upload", err)
+		return
+	}
+	respondUploaded(c, meta, deleteToken, files)
+}
+
+// discardUpload removes what a failed upload stored under randomID. It also
+// runs when the request was canceled, as happens to uploads cut off by a
+// shutdown, so nothing partial is left behind.
+func discardUpload(c *gin.Context, randomID string) {
+	ctx := context.WithoutCancel(c.Request.Context())
+	if err := store.DeletePrefix(ctx, randomID+"/"); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		requestLogger(c).Error("Failed to remove partial upload", "id", randomID, "error", err)
+	}
+}
+
+// addToUpload stores source under an existing random ID. The caller must hold
+// the delete token of that ID.
+func addToUpload(c *gin.Context, randomID, deleteToken string, source uploadSource) {
+	if !checkUploadFilenames(c, []uploadSource{source}) {
+		return
+	}
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, fmt.Sprintf("Upload %s not found", randomID), err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
 		return
 	}
-	if bytesWritten > config.MaxUploadSize {
-		if config.StorageType == StorageLocal {
-			os.Remove(fullStoragePath)
+	if !meta.checkDeleteToken(deleteToken) {
+		abortWithError(c, http.StatusForbidden, "Invalid or missing delete token", nil)
+		return
+	}
+	unlock := lockMetadata(randomID)
+	defer unlock()
+	if meta, err = loadMetadata(c.Request.Context(), randomID); err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	if err := meta.available(time.Now()); errors.Is(err, errUploadIncomplete) {
+		abortWithError(c, http.StatusConflict, "Upload is still in progress", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusGone, "Upload is no longer available", err)
+		return
+	}
+	// A file of the same name is only replaced once the new content is
+	// complete and verified, so a failed upload leaves it and its entry alone.
+	file, ok := storeUploadedFile(c, randomID, source, time.Now().UTC())
+	if !ok {
+		return
+	}
+	meta.Files = mergeFiles(meta.Files, recordedFiles([]fileMetadata{*file}))
+	if err := saveMetadata(c.Request.Context(), meta); err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to record upload", err)
+		return
+	}
+	respondUploaded(c, meta, deleteToken, []fileMetadata{*file})
+}
+
+// checkUploadFilenames rejects invalid or repeated filenames before anything is stored.
+func checkUploadFilenames(c *gin.Context, sources []uploadSource) bool {
+	seen := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		sanitizedFilename, err := getSanitizedUserPath(source.filename)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "Invalid filename provided", err)
+			return false
 		}
-		abortWithError(c, http.StatusRequestEntityTooLarge,
-			fmt.Sprintf("Uploaded file size (%d bytes) exceeds maximum allowed size (%d bytes)", bytesWritten, config.MaxUploadSize), nil)
+		if seen[sanitizedFilename] {
+			abortWithError(c, http.StatusBadRequest, fmt.Sprintf("Filename %s appears more than once", sanitizedFilename), nil)
+			return false
+		}
+		seen[sanitizedFilename] = true
+	}
+	return true
+}
+
+// storeUploadedFile writes one file under randomID and returns its record
+// entry. On failure it responds to the client itself and returns false.
+func storeUploadedFile(c *gin.Context, randomID string, source uploadSource, uploadedAt time.Time) (*fileMetadata, bool) {
+	body, err := source.open()
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Failed to read upload body", err)
+		return nil, false
+	}
+	defer body.Close()
+	file, err := putUploadedFile(c.Request.Context(), randomID, source.filename, body, uploadedAt, source.expected, source.encrypt)
+	if err != nil {
+		abortWithUploadError(c, err)
+		return nil, false
+	}
+	return file, true
+}
+
+// uploadError carries the response for a failed upload step out of code that
+// has no access to the request.
+type uploadError struct {
+	status  int
+	message string
+	err     error
+}
+
+func (e *uploadError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+func abortWithUploadError(c *gin.Context, err error) {
+	var uploadErr *uploadError
+	if errors.As(err, &uploadErr) {
+		abortWithError(c, uploadErr.status, uploadErr.message, uploadErr.err)
 		return
 	}
-	urlEncodedFilename := url.PathEscape(sanitizedFilename)
-	accessURL := fmt.Sprintf("%s/%s/%s", getBaseURL(c.Request), randomID, urlEncodedFilename)
-	deleteCommand := fmt.Sprintf("curl -X DELETE '%s'", accessURL)
+	abortWithError(c, http.StatusInternalServerError, "Failed to save file", err)
+}
+
+// putUploadedFile writes body to filename under randomID, sniffing its content
+// type and hashing it on the way. If the content does not match expected, the
+// stored file is removed again. With encrypt, the file is stored encrypted and
+// the returned entry carries its key. Errors are *uploadError.
+func putUploadedFile(ctx context.Context, randomID, filename string, body io.Reader, uploadedAt time.Time, expected fileChecksums, encrypt bool) (*fileMetadata, error) {
+	sanitizedFilename, err := getSanitizedUserPath(filename)
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "Invalid filename provided", err}
+	}
+	storageKey, err := buildAndVerifyStoragePath(randomID, sanitizedFilename)
+	if err != nil {
+		return nil, &uploadError{http.StatusInternalServerError, "Failed to prepare storage path", err}
+	}
+	contentType, bodyReader, err := sniffContentType(body, sanitizedFilename)
+	if err != nil {
+		return nil, &uploadError{http.StatusBadRequest, "Failed to read upload body", err}
+	}
+	sizeLimit := uploadSizeLimit(ctx)
+	limitedReader := newSizeLimitedReader(bodyReader, sizeLimit)
+	sha256Hasher, md5Hasher := sha256.New(), md5.New()
+	counter := &countingReader{r: io.TeeReader(limitedReader, io.MultiWriter(sha256Hasher, md5Hasher))}
+	// A mismatch is reported in place of the end of the body, so the store
+	// abandons the write and a file being replaced keeps its old content.
+	var mismatch string
+	var content io.Reader = &verifiedReader{r: counter, verify: func() error {
+		sums := &fileMetadata{SHA256: hex.EncodeToString(sha256Hasher.Sum(nil)), MD5: hex.EncodeToString(md5Hasher.Sum(nil))}
+		if mismatch = expected.mismatch(sums); mismatch != "" {
+			return errChecksumMismatch
+		}
+		return nil
+	}}
+	var key []byte
+	if encrypt {
+		if key, err = generateEncryptionKey(); err == nil {
+			content, err = newEncryptingReader(content, key)
+		}
+		if err != nil {
+			return nil, &uploadError{http.StatusInternalServerError, "Failed to prepare encryption", err}
+		}
+	}
+	_, err = store.Put(ctx, storageKey, content)
+	if limitedReader.exceeded {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Uploaded file %s exceeds maximum allowed size (%d bytes)", sanitizedFilename, sizeLimit), err}
+	}
+	if mismatch != "" {
+		return nil, &uploadError{http.StatusBadRequest,
+			fmt.Sprintf("%s checksum of %s does not match, upload discarded", mismatch, sanitizedFilename), nil}
+	}
+	if err != nil {
+		return nil, &uploadError{http.StatusInternalServerError, "Failed to save file", err}
+	}
+	file := &fileMetadata{
+		Path:             sanitizedFilename,
+		OriginalFilename: filename,
+		ContentType:      contentType,
+		Size:             counter.n,
+		SHA256:           hex.EncodeToString(sha256Hasher.Sum(nil)),
+		MD5:              hex.EncodeToString(md5Hasher.Sum(nil)),
+		UploadedAt:       uploadedAt,
+	}
+	if key != nil {
+		file.Key = key
+		file.KeyHash = hashEncryptionKey(key)
+	}
+	chargeUpload(ctx, file.Size)
+	return file, nil
+}
+
+// mismatch names the first expected checksum that file does not match, or
+// returns "" if all of them match.
+func (expected fileChecksums) mismatch(file *fileMetadata) string {
+	if expected.SHA256 != "" && expected.SHA256 != file.SHA256 {
+		return "SHA-256"
+	}
+	if expected.MD5 != "" && expected.MD5 != file.MD5 {
+		return "MD5"
+	}
+	return ""
+}
+
+// recordedFiles returns files as they are kept in the upload record. Checksums
+// of encrypted files are left out, so the record reveals nothing about their
+// content.
+func recordedFiles(files []fileMetadata) []fileMetadata {
+	recorded := make([]fileMetadata, len(files))
+	for i, file := range files {
+		if file.encrypted() {
+			file.SHA256, file.MD5 = "", ""
+		}
+		recorded[i] = file
+	}
+	return recorded
+}
+
+// fileURL returns the download URL of file under randomID, including the
+// decryption key when the entry carries one.
+func fileURL(baseURL, randomID string, file fileMetadata) string {
+	if file.Key != nil {
+		randomID += encryptionKeySeparator + hex.EncodeToString(file.Key)
+	}
+	return fmt.Sprintf("%s/%s/%s", baseURL, randomID, url.PathEscape(file.Path))
+}
+
+// respondUploaded reports the files just stored under meta.ID, as plain text
+// for curl and wget and as JSON for everything else.
+func respondUploaded(c *gin.Context, meta *uploadMetadata, deleteToken string, uploaded []fileMetadata) {
+	baseURL := getBaseURL(c.Request)
+	bundleURL := fmt.Sprintf("%s/%s/", baseURL, meta.ID)
+	var totalSize int64
+	fileURLs := make([]string, len(uploaded))
+	fileEntries := make([]gin.H, len(uploaded))
+	for i, file := range uploaded {
+		fileURLs[i] = fileURL(baseURL, meta.ID, file)
+		totalSize += file.Size
+		fileEntries[i] = gin.H{
+			"filepath":  file.Path,
+			"url":       fileURLs[i],
+			"size":      file.Size,
+			"sha256":    file.SHA256,
+			"md5":       file.MD5,
+			"encrypted": file.encrypted(),
+		}
+	}
+	deleteURL := fileURLs[0]
+	if len(meta.Files) > 1 {
+		deleteURL = bundleURL
+	}
+	deleteCommand := fmt.Sprintf("curl -X DELETE -H '%s: %s' '%s'", deleteTokenHeader, deleteToken, deleteURL)
 
 	userAgent := c.GetHeader("User-Agent")
 	if strings.Contains(userAgent, "curl") || strings.Contains(userAgent, "Wget") {
-		c.Header("Content-Type", "text/plain; charset=utf-8")
-		c.String(http.StatusCreated,
-			"\n=========================\n\n"+
-				"Uploaded Success, size %d\n\n"+
-				"Get File:\n\n"+
-				"wget %s\n\n"+
-				"Delete File:\n\n"+
-				"curl -X DELETE %s\n\n"+
-				"=========================\n\n",
-			bytesWritten, accessURL, accessURL)
+		var text strings.Builder
+		text.WriteString("\n=========================\n\n")
+		if len(uploaded) == 1 {
+			fmt.Fprintf(&text, "Uploaded Success, size %d\n\n", totalSize)
+		} else {
+			fmt.Fprintf(&text, "Uploaded Success, %d files, size %d\n\n", len(uploaded), totalSize)
+		}
+		fmt.Fprintf(&text, "Expires: %s\n\n", meta.ExpiresAt.Format(time.RFC3339))
+		if meta.PasswordHash != "" {
+			text.WriteString("Password protected: add --user=x --password=<password> to wget\n\n")
+		}
+		text.WriteString("Get File:\n\n")
+		for _, fileURL := range fileURLs {
+			fmt.Fprintf(&text, "wget %s\n", fileURL)
+		}
+		if len(meta.Files) > 1 {
+			fmt.Fprintf(&text, "\nAll Files:\n\n%s\n", bundleURL)
+		}
+		text.WriteString("\nSHA256:\n\n")
+		for _, file := range uploaded {
+			fmt.Fprintf(&text, "%s  %s\n", file.SHA256, file.Path)
+		}
+		fmt.Fprintf(&text, "\nDelete File:\n\n%s\n\n", deleteCommand)
+		text.WriteString("=========================\n\n")
+		c.Data(http.StatusCreated, "text/plain; charset=utf-8", []byte(text.String()))
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message":        "File uploaded successfully",
-		"id":             randomID,
-		"filepath":       sanitizedFilename,
-		"url":            accessURL,
-		"delete_command": deleteCommand,
-		"size":           bytesWritten,
+		"message":            "File uploaded successfully",
+		"id":                 meta.ID,
+		"filepath":           uploaded[0].Path,
+		"url":                fileURLs[0],
+		"sha256":             uploaded[0].SHA256,
+		"md5":                uploaded[0].MD5,
+		"files":              fileEntries,
+		"bundle_url":         bundleURL,
+		"delete_command":     deleteCommand,
+		"delete_token":       deleteToken,
+		"size":               totalSize,
+		"expires_at":         meta.ExpiresAt,
+		"max_downloads":      meta.MaxDownloads,
+		"password_protected": meta.PasswordHash != "",
 	})
 }
 
+// handleUploadPost accepts one or more "file" fields and stores them under one random ID.
 func handleUploadPost(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
-	if err != nil {
+	// The size limit covers all files of the request together. The body is
+	// capped before it is parsed, so an oversized request is not spooled to disk.
+	sizeLimit := uploadSizeLimit(c.Request.Context())
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, sizeLimit+multipartOverhead)
+	form, err := c.MultipartForm()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Upload exceeds maximum allowed size (%d bytes)", sizeLimit), err)
+		return
+	} else if err != nil {
 		abortWithError(c, http.StatusBadRequest, "Failed to get file from form", err)
 		return
 	}
-	defer file.Close()
-	originalFilename := header.Filename
-	commonUploadLogic(c, originalFilename, file, false)
+	headers := form.File["file"]
+	if len(headers) == 0 {
+		abortWithError(c, http.StatusBadRequest, "Failed to get file from form", http.ErrMissingFile)
+		return
+	}
+	var totalSize int64
+	for _, header := range headers {
+		totalSize += header.Size
+	}
+	if totalSize > sizeLimit {
+		abortWithError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Uploaded files total %d bytes, exceeding maximum allowed size (%d bytes)", totalSize, sizeLimit), nil)
+		return
+	}
+	expected, err := parseExpectedChecksums(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid expected checksum", err)
+		return
+	}
+	if expected != (fileChecksums{}) && len(headers) > 1 {
+		abortWithError(c, http.StatusBadRequest, "Expected checksums can only be given for a single file", nil)
+		return
+	}
+	encrypt, err := uploadFlag(c, encryptHeader, "encrypt")
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid upload options", err)
+		return
+	}
+	sources := make([]uploadSource, len(headers))
+	for i, header := range headers {
+		header := header
+		sources[i] = uploadSource{
+			filename: header.Filename,
+			open: func() (io.ReadCloser, error) {
+				return header.Open()
+			},
+			expected: expected,
+			encrypt:  encrypt,
+		}
+	}
+	commonUploadLogic(c, sources, false)
 }
 
+// handleUploadPut stores the request body under a new random ID, or, when a
+// delete token is given, under the existing ID named by the first path segment.
 func handleUploadPut(c *gin.Context) {
 	userPath := c.Param("filepath")
 	if userPath == "" || userPath == "/" {
 		abortWithError(c, http.StatusBadRequest, "Filepath for PUT cannot be empty", nil)
 		return
 	}
-	commonUploadLogic(c, userPath, c.Request.Body, true)
+	userPath = strings.TrimPrefix(userPath, "/")
+	expected, err := parseExpectedChecksums(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid expected checksum", err)
+		return
+	}
+	encrypt, err := uploadFlag(c, encryptHeader, "encrypt")
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid upload options", err)
+		return
+	}
+	source := uploadSource{
+		filename: userPath,
+		open: func() (io.ReadCloser, error) {
+			return c.Request.Body, nil
+		},
+		expected: expected,
+		encrypt:  encrypt,
+	}
+	if deleteToken := getDeleteToken(c); deleteToken != "" {
+		randomID, filename, found := strings.Cut(userPath, "/")
+		if !found {
+			abortWithError(c, http.StatusBadRequest, "PUT with a delete token must target /<random_id>/<filepath>", nil)
+			return
+		}
+		source.filename = filename
+		addToUpload(c, randomID, deleteToken, source)
+		return
+	}
+	commonUploadLogic(c, []uploadSource{source}, true)
 }
 
 func handleDownloadFile(c *gin.Context) {
-	randomID := c.Param("random_id")
+	randomID, key, err := splitEncryptionKey(c.Param("random_id"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid decryption key in URL", err)
+		return
+	}
+	if !checkSignedURL(c, randomID) || !checkDownloadPassword(c, randomID) {
+		return
+	}
+	if strings.Trim(c.Param("filepath"), "/ ") == "" {
+		if format := c.Query("archive"); format != "" {
+			handleArchiveDownload(c, randomID, format)
+			return
+		}
+		handleListFiles(c, randomID)
+		return
+	}
 	userFilePath, err := getSanitizedUserPath(c.Param("filepath"))
 	if err != nil {
 		abortWithError(c, http.StatusBadRequest, "Invalid filepath in URL", err)
 		return
 	}
-	fullStoragePath, _, err := buildAndVerifyStoragePath(randomID, userFilePath)
+	storageKey, err := buildAndVerifyStoragePath(randomID, userFilePath)
 	if err != nil {
-		abortWithError(c, http.StatusInternalServerError, "Error accessing file path", err)
+		abortWithError(c, http.StatusBadRequest, "Error accessing file path", err)
 		return
 	}
-	if config.StorageType == StorageR2 {
-		rel, err := filepath.Rel(config.BaseStoragePath, fullStoragePath)
-		if err != nil {
-			abortWithError(c, http.StatusInternalServerError, "Failed to get R2 key", err)
+	if _, ok := c.GetQuery("info"); ok {
+		handleFileInfo(c, randomID, userFilePath, key)
+		return
+	}
+	if !checkDecryptionKey(c, randomID, userFilePath, key) {
+		return
+	}
+	meta, err := claimDownload(c.Request.Context(), randomID, false)
+	if errors.Is(err, errUploadExpired) || errors.Is(err, errDownloadLimitReached) {
+		abortWithError(c, http.StatusGone, "File is no longer available", err)
+		return
+	} else if errors.Is(err, errUploadIncomplete) || errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "File not found", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	// Resolve the file before counting, so requests for files that do not
+	// exist leave Max-Downloads alone.
+	file := meta.file(userFilePath)
+	if file == nil {
+		abortWithError(c, http.StatusNotFound, "File not found", nil)
+		return
+	}
+	// Encrypted files are always sent whole, whatever the Range header says.
+	if file.encrypted() || isNewDownload(c.Request) {
+		if meta, err = countDownload(c.Request.Context(), randomID); errors.Is(err, errUploadExpired) || errors.Is(err, errDownloadLimitReached) {
+			abortWithError(c, http.StatusGone, "File is no longer available", err)
+			return
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
 			return
 		}
-		key := filepath.ToSlash(rel)
-		getObj := &s3.GetObjectInput{
-			Bucket: aws.String(r2Bucket),
-			Key:    aws.String(key),
+	}
+	if file.encrypted() {
+		serveDecryptedFile(c, meta, file, storageKey, key)
+		return
+	}
+	downloadFilename := filepath.Base(userFilePath)
+	if getter, ok := store.(conditionalGetter); ok {
+		reqHeader := c.Request.Header
+		etag := fileETag(meta, userFilePath)
+		if etag != "" {
+			var status int
+			if reqHeader, status = evaluateETagConditions(reqHeader, etag); status != 0 {
+				c.Header("ETag", etag)
+				c.Status(status)
+				return
+			}
 		}
-		obj, err := s3Client.GetObject(getObj)
-		if err != nil {
+		obj, err := getter.GetConditional(c.Request.Context(), storageKey, reqHeader)
+		if errors.Is(err, ErrObjectNotFound) {
 			abortWithError(c, http.StatusNotFound, "File not found", err)
 			return
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, "Error reading file", err)
+			return
+		}
+		for name, values := range obj.Header {
+			c.Writer.Header()[name] = values
+		}
+		if etag != "" {
+			c.Header("ETag", etag)
+		}
+		if meta != nil {
+			c.Header("X-Expires-At", meta.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		setDigestHeader(c, meta, userFilePath)
+		if obj.Body == nil {
+			c.Status(obj.Status)
+			return
 		}
 		defer obj.Body.Close()
-		downloadFilename := filepath.Base(userFilePath)
-		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, downloadFilename))
-		c.Header("Content-Type", "application/octet-stream")
-		logger.Printf("Serving file %s for download (from R2).", key)
+		setContentHeaders(c, meta, userFilePath)
+		requestLogger(c).Info("Serving file", "key", storageKey, "storage", currentConfig().StorageType, "status", obj.Status)
+		c.Status(obj.Status)
 		io.Copy(c.Writer, obj.Body)
 		return
 	}
-	if _, statErr := os.Stat(fullStoragePath); os.IsNotExist(statErr) {
-		abortWithError(c, http.StatusNotFound, "File not found", statErr)
+	content, info, err := store.Get(c.Request.Context(), storageKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "File not found", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error reading file", err)
+		return
+	}
+	defer content.Close()
+	setObjectHeaders(c, meta, userFilePath, info)
+	setContentHeaders(c, meta, userFilePath)
+	requestLogger(c).Info("Serving file", "key", storageKey, "storage", currentConfig().StorageType)
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, downloadFilename, uploadedAt(meta, userFilePath, info.ModTime), seeker)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, content)
+}
+
+// checkDecryptionKey rejects a download of an encrypted file unless key is the
+// one it was encrypted with, before the download is counted. It writes the
+// error response itself.
+func checkDecryptionKey(c *gin.Context, randomID, userFilePath string, key []byte) bool {
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		return true
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return false
+	}
+	if file := meta.file(userFilePath); file != nil && file.encrypted() && !file.checkEncryptionKey(key) {
+		abortWithError(c, http.StatusForbidden, "Missing or wrong decryption key", nil)
+		return false
+	}
+	return true
+}
+
+// serveDecryptedFile streams an encrypted file as plaintext. The ciphertext
+// cannot be seeked by plaintext offset, so Range requests get the whole file.
+func serveDecryptedFile(c *gin.Context, meta *uploadMetadata, file *fileMetadata, storageKey string, key []byte) {
+	content, info, err := store.Get(c.Request.Context(), storageKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "File not found", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error reading file", err)
+		return
+	}
+	defer content.Close()
+	plaintext, err := newDecryptingReader(content, key)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error decrypting file", err)
+		return
+	}
+	setContentHeaders(c, meta, file.Path)
+	c.Header("Content-Length", strconv.FormatInt(file.Size, 10))
+	c.Header("Last-Modified", uploadedAt(meta, file.Path, info.ModTime).UTC().Format(http.TimeFormat))
+	c.Header("X-Expires-At", meta.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Header("Accept-Ranges", "none")
+	c.Header("Cache-Control", "private, no-store")
+	requestLogger(c).Info("Serving encrypted file", "key", storageKey, "storage", currentConfig().StorageType)
+	c.Status(http.StatusOK)
+	buf := make([]byte, bufferSize)
+	if _, err := io.CopyBuffer(c.Writer, plaintext, buf); err != nil {
+		requestLogger(c).Error("Encrypted download failed after headers were sent", "key", storageKey, "error", err)
+		c.Abort()
+	}
+}
+
+// handleHeadFile answers HEAD /:random_id/*filepath with the headers a download
+// would carry, so clients can check a link without fetching it.
+func handleHeadFile(c *gin.Context) {
+	randomID, _, err := splitEncryptionKey(c.Param("random_id"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid decryption key in URL", err)
+		return
+	}
+	if !checkSignedURL(c, randomID) || !checkDownloadPassword(c, randomID) {
+		return
+	}
+	userFilePath, err := getSanitizedUserPath(c.Param("filepath"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid filepath in URL", err)
+		return
+	}
+	storageKey, err := buildAndVerifyStoragePath(randomID, userFilePath)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Error accessing file path", err)
+		return
+	}
+	meta, err := claimDownload(c.Request.Context(), randomID, false)
+	if errors.Is(err, errUploadExpired) || errors.Is(err, errDownloadLimitReached) {
+		abortWithError(c, http.StatusGone, "File is no longer available", err)
+		return
+	} else if errors.Is(err, errUploadIncomplete) || errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "File not found", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	info, err := store.Stat(c.Request.Context(), storageKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "File not found", err)
 		return
-	} else if statErr != nil {
-		abortWithError(c, http.StatusInternalServerError, "Error checking file status", statErr)
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error checking file status", err)
 		return
 	}
+	setObjectHeaders(c, meta, userFilePath, info)
+	setContentHeaders(c, meta, userFilePath)
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Header("Accept-Ranges", "bytes")
+	if meta != nil {
+		if file := meta.file(userFilePath); file != nil && file.encrypted() {
+			c.Header("Content-Length", strconv.FormatInt(file.Size, 10))
+			c.Header("Accept-Ranges", "none")
+		}
+	}
+	c.Status(http.StatusOK)
+}
+
+// setContentHeaders sets Content-Type and Content-Disposition. With ?inline=1,
+// safe types recorded at upload are rendered by the browser; active types such as
+// HTML and SVG, and uploads without a record, are always sent as attachments.
+func setContentHeaders(c *gin.Context, meta *uploadMetadata, userFilePath string) {
 	downloadFilename := filepath.Base(userFilePath)
-	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, downloadFilename))
+	if c.Query("inline") == "1" && meta != nil {
+		if file := meta.file(userFilePath); file != nil {
+			if contentType, ok := inlineContentType(file.ContentType); ok {
+				c.Header("Content-Type", contentType)
+				c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, downloadFilename))
+				if contentType != "application/pdf" {
+					c.Header("Content-Security-Policy", inlineCSP)
+				}
+				return
+			}
+		}
+	}
 	c.Header("Content-Type", "application/octet-stream")
-	logger.Printf("Serving file %s for download.", fullStoragePath)
-	c.File(fullStoragePath)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, downloadFilename))
+}
+
+// setObjectHeaders sets ETag, Last-Modified and X-Expires-At for a stored file.
+// meta may be nil for uploads without a record, in which case the expiry falls
+// back to the global retention policy.
+func setObjectHeaders(c *gin.Context, meta *uploadMetadata, userFilePath string, info *ObjectInfo) {
+	etag := info.ETag
+	expiresAt := info.ModTime.Add(time.Duration(currentConfig().RetentionSeconds) * time.Second)
+	if meta != nil {
+		expiresAt = meta.ExpiresAt
+	}
+	if sha256ETag := fileETag(meta, userFilePath); sha256ETag != "" {
+		etag = sha256ETag
+	}
+	if etag == "" {
+		etag = fmt.Sprintf(`W/"%x-%x"`, info.Size, info.ModTime.UnixNano())
+	}
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", uploadedAt(meta, userFilePath, info.ModTime).UTC().Format(http.TimeFormat))
+	c.Header("X-Expires-At", expiresAt.UTC().Format(http.TimeFormat))
+	setDigestHeader(c, meta, userFilePath)
+}
+
+// fileETag returns the ETag of a file with a recorded SHA-256 checksum, or ""
+// when the backend's own ETag has to be used.
+func fileETag(meta *uploadMetadata, userFilePath string) string {
+	if meta == nil {
+		return ""
+	}
+	if file := meta.file(userFilePath); file != nil && file.SHA256 != "" {
+		return fmt.Sprintf(`"%s"`, file.SHA256)
+	}
+	return ""
+}
+
+// evaluateETagConditions checks If-Match, If-None-Match and If-Range against
+// etag, which the backend does not know, and returns the request headers with
+// those conditions resolved. A non-zero status means the request is answered
+// with it and no body.
+func evaluateETagConditions(reqHeader http.Header, etag string) (http.Header, int) {
+	if ifMatch := reqHeader.Get("If-Match"); ifMatch != "" && !etagListMatches(ifMatch, etag, false) {
+		return reqHeader, http.StatusPreconditionFailed
+	}
+	if ifNoneMatch := reqHeader.Get("If-None-Match"); ifNoneMatch != "" && etagListMatches(ifNoneMatch, etag, true) {
+		return reqHeader, http.StatusNotModified
+	}
+	resolved := reqHeader.Clone()
+	resolved.Del("If-Match")
+	if resolved.Get("If-None-Match") != "" {
+		// A failed If-None-Match overrides If-Modified-Since.
+		resolved.Del("If-None-Match")
+		resolved.Del("If-Modified-Since")
+	}
+	if ifRange := resolved.Get("If-Range"); ifRange != "" && strings.HasPrefix(ifRange, `"`) {
+		if ifRange != etag {
+			resolved.Del("Range")
+		}
+		resolved.Del("If-Range")
+	}
+	return resolved, 0
+}
+
+// etagListMatches reports whether the comma-separated entity tags in list
+// include etag or "*". Weak tags only match when weak comparison is allowed.
+func etagListMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setDigestHeader sets an RFC 3230 Digest header from the checksums recorded at
+// upload, so clients can verify the whole file after downloading it.
+func setDigestHeader(c *gin.Context, meta *uploadMetadata, userFilePath string) {
+	if meta == nil {
+		return
+	}
+	file := meta.file(userFilePath)
+	if file == nil {
+		return
+	}
+	var digests []string
+	for _, checksum := range []struct{ algorithm, value string }{{"sha-256", file.SHA256}, {"md5", file.MD5}} {
+		if sum, err := hex.DecodeString(checksum.value); err == nil && len(sum) > 0 {
+			digests = append(digests, checksum.algorithm+"="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+	if len(digests) > 0 {
+		c.Header("Digest", strings.Join(digests, ","))
+	}
+}
+
+// handleFileInfo serves the public part of an upload's metadata record for GET /:random_id/*filepath?info.
+// The original name and content type of an encrypted file are only shown when
+// the link carries its decryption key.
+func handleFileInfo(c *gin.Context, randomID, userFilePath string, key []byte) {
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "File not found", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	file := meta.file(userFilePath)
+	if file == nil {
+		abortWithError(c, http.StatusNotFound, "File not found", nil)
+		return
+	}
+	originalFilename, contentType := file.OriginalFilename, file.ContentType
+	if file.encrypted() && !file.checkEncryptionKey(key) {
+		originalFilename, contentType = "", ""
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":                randomID,
+		"filepath":          file.Path,
+		"original_filename": originalFilename,
+		"content_type":      contentType,
+		"size":              file.Size,
+		"sha256":            file.SHA256,
+		"md5":               file.MD5,
+		"encrypted":         file.encrypted(),
+		"uploaded_at":       file.UploadedAt,
+		"expires_at":        meta.ExpiresAt,
+		"max_downloads":     meta.MaxDownloads,
+		"downloads":         meta.Downloads,
+		"available":         meta.available(time.Now()) == nil,
+	})
 }
 
 func handleDeleteFile(c *gin.Context) {
-	randomID := c.Param("random_id")
+	// Links to encrypted files carry their key, which deletion does not need.
+	randomID, _, _ := strings.Cut(c.Param("random_id"), encryptionKeySeparator)
 	userFilePath, err := getSanitizedUserPath(c.Param("filepath"))
 	if err != nil {
 		targetErr := errors.New("filepath cannot be empty")
@@ -154,116 +914,172 @@ func handleDeleteFile(c *gin.Context) {
 			return
 		}
 	}
-	var pathToOperateOn string
+	storageKey, err := buildAndVerifyStoragePath(randomID, userFilePath)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Error accessing file path for deletion", err)
+		return
+	}
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, fmt.Sprintf("Path %s not found for deletion", userFilePath), err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	if !meta.checkDeleteToken(getDeleteToken(c)) {
+		abortWithError(c, http.StatusForbidden, "Invalid or missing delete token", nil)
+		return
+	}
 	var operationDescription string
-	var r2Key string
 	if userFilePath == "" {
-		_, dirPath, errBuild := buildAndVerifyStoragePath(randomID, ".")
-		if errBuild != nil {
-			abortWithError(c, http.StatusInternalServerError, "Error accessing directory path for deletion", errBuild)
-			return
-		}
-		pathToOperateOn = dirPath
-		operationDescription = fmt.Sprintf("directory %s and all its contents", dirPath)
-		absBasePath, _ := filepath.Abs(config.BaseStoragePath)
-		absPathToOperate, _ := filepath.Abs(pathToOperateOn)
-		if absPathToOperate == absBasePath {
-			abortWithError(c, http.StatusForbidden, "Cannot delete base storage directory", nil)
-			return
+		operationDescription = fmt.Sprintf("directory %s and all its contents", storageKey)
+		err = store.DeletePrefix(c.Request.Context(), storageKey+"/")
+		if err == nil {
+			if metaErr := deleteMetadata(c.Request.Context(), randomID); metaErr != nil {
+				requestLogger(c).Error("Failed to delete upload record", "id", randomID, "error", metaErr)
+			}
 		}
-		rel, _ := filepath.Rel(config.BaseStoragePath, pathToOperateOn)
-		r2Key = filepath.ToSlash(rel)
 	} else {
-		fullStoragePath, _, errBuild := buildAndVerifyStoragePath(randomID, userFilePath)
-		if errBuild != nil {
-			abortWithError(c, http.StatusInternalServerError, "Error accessing file path for deletion", errBuild)
-			return
+		operationDescription = fmt.Sprintf("file %s", storageKey)
+		if _, err = store.Stat(c.Request.Context(), storageKey); err == nil {
+			err = store.Delete(c.Request.Context(), storageKey)
 		}
-		pathToOperateOn = fullStoragePath
-		operationDescription = fmt.Sprintf("file %s", userFilePath)
-		rel, _ := filepath.Rel(config.BaseStoragePath, pathToOperateOn)
-		r2Key = filepath.ToSlash(rel)
-	}
-	if config.StorageType == StorageR2 {
-		if userFilePath == "" {
-			prefix := randomID + "/"
-			listInput := &s3.ListObjectsV2Input{
-				Bucket: aws.String(r2Bucket),
-				Prefix: aws.String(prefix),
-			}
-			err := s3Client.ListObjectsV2Pages(listInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-				for _, obj := range page.Contents {
-					_, delErr := s3Client.DeleteObject(&s3.DeleteObjectInput{
-						Bucket: aws.String(r2Bucket),
-						Key:    obj.Key,
-					})
-					if delErr != nil {
-						logger.Printf("Failed to delete object %s: %v", *obj.Key, delErr)
-					}
-				}
-				return !lastPage
-			})
-			if err != nil {
-				abortWithError(c, http.StatusInternalServerError, "Failed to delete directory in R2", err)
-				return
-			}
-			logger.Printf("Successfully deleted directory %s and all its contents (R2).", prefix)
-		} else {
-			_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
-				Bucket: aws.String(r2Bucket),
-				Key:    aws.String(r2Key),
-			})
-			if err != nil {
-				abortWithError(c, http.StatusInternalServerError, "Failed to delete file in R2", err)
-				return
+		if err == nil {
+			if metaErr := forgetFile(c.Request.Context(), randomID, userFilePath); metaErr != nil {
+				requestLogger(c).Error("Failed to update upload record", "id", randomID, "error", metaErr)
 			}
-			logger.Printf("Successfully deleted file %s (R2).", r2Key)
 		}
-		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Successfully deleted %s", userFilePath)})
-		return
 	}
-	if _, statErr := os.Stat(pathToOperateOn); os.IsNotExist(statErr) {
-		abortWithError(c, http.StatusNotFound, fmt.Sprintf("Path %s not found for deletion", userFilePath), statErr)
-		return
-	} else if statErr != nil {
-		abortWithError(c, http.StatusInternalServerError, "Error checking path status for deletion", statErr)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, fmt.Sprintf("Path %s not found for deletion", userFilePath), err)
 		return
-	}
-	if err := os.RemoveAll(pathToOperateOn); err != nil {
+	} else if err != nil {
 		abortWithError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to delete %s", operationDescription), err)
 		return
 	}
-	logger.Printf("Successfully deleted %s.", operationDescription)
+	requestLogger(c).Info("Deleted", "target", operationDescription, "storage", currentConfig().StorageType)
 	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Successfully deleted %s", userFilePath)})
 }
 
-func handleGetMaxUploadSize(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"max_upload_size": config.MaxUploadSize,
-	})
+type uploadOptions struct {
+	createdAt    time.Time
+	expiresAt    time.Time
+	maxDownloads int64
+	extract      bool
+	passwordHash string
 }
 
-func handleSetMaxUploadSize(c *gin.Context) {
-	password := c.Query("password")
-	expected := os.Getenv(envConfigAPIPassword)
-	if expected == "" || password != expected {
-		abortWithError(c, http.StatusUnauthorized, "Unauthorized", nil)
-		return
+// parseUploadOptions reads the Max-Days, Max-Downloads, X-Extract and
+// X-Download-Password headers, or the max_days, max_downloads, extract and
+// password form fields, and caps them to the server limits. Uploads never
+// outlive RetentionSeconds, or the retention limit of their API key.
+func parseUploadOptions(c *gin.Context) (uploadOptions, error) {
+	options := uploadOptions{createdAt: time.Now().UTC()}
+	var err error
+	if options.extract, err = uploadFlag(c, extractHeader, "extract"); err != nil {
+		return options, err
 	}
-	sizeStr := c.Query("size")
-	if sizeStr == "" {
-		abortWithError(c, http.StatusBadRequest, "Missing size parameter", nil)
-		return
+	retention := uploadRetention(c.Request.Context())
+	options.expiresAt = options.createdAt.Add(retention)
+	if maxDaysStr := uploadOption(c, maxDaysHeader, "max_days"); maxDaysStr != "" {
+		maxDays, err := strconv.ParseFloat(maxDaysStr, 64)
+		if err != nil || math.IsNaN(maxDays) || math.IsInf(maxDays, 0) || maxDays <= 0 {
+			return options, fmt.Errorf("invalid %s value '%s'", maxDaysHeader, maxDaysStr)
+		}
+		// Compared as floats, since a huge value overflows time.Duration.
+		if lifetime := maxDays * float64(24*time.Hour); lifetime < float64(retention) {
+			options.expiresAt = options.createdAt.Add(time.Duration(lifetime))
+		}
 	}
-	size, err := strconv.ParseInt(sizeStr, 10, 64)
-	if err != nil || size <= 0 {
-		abortWithError(c, http.StatusBadRequest, "Invalid size value", err)
-		return
+	if maxDownloadsStr := uploadOption(c, maxDownloadsHeader, "max_downloads"); maxDownloadsStr != "" {
+		maxDownloads, err := strconv.ParseInt(maxDownloadsStr, 10, 64)
+		if err != nil || maxDownloads <= 0 {
+			return options, fmt.Errorf("invalid %s value '%s'", maxDownloadsHeader, maxDownloadsStr)
+		}
+		options.maxDownloads = maxDownloads
+	}
+	if currentConfig().MaxDownloadsLimit > 0 && (options.maxDownloads == 0 || options.maxDownloads > currentConfig().MaxDownloadsLimit) {
+		options.maxDownloads = currentConfig().MaxDownloadsLimit
+	}
+	if password := uploadOption(c, downloadPasswordHeader, "password"); password != "" {
+		if options.passwordHash, err = hashDownloadPassword(password); err != nil {
+			return options, fmt.Errorf("invalid %s value: %w", downloadPasswordHeader, err)
+		}
+	}
+	return options, nil
+}
+
+// parseExpectedChecksums reads the hex digests an uploader expects, from the
+// X-Expected-Sha256 and X-Expected-Md5 headers or the sha256 and md5 form fields.
+func parseExpectedChecksums(c *gin.Context) (fileChecksums, error) {
+	expected := fileChecksums{
+		SHA256: strings.ToLower(uploadOption(c, expectedSHA256Header, "sha256")),
+		MD5:    strings.ToLower(uploadOption(c, expectedMD5Header, "md5")),
+	}
+	if _, err := hex.DecodeString(expected.SHA256); err != nil || (expected.SHA256 != "" && len(expected.SHA256) != 2*sha256.Size) {
+		return fileChecksums{}, fmt.Errorf("invalid %s value '%s'", expectedSHA256Header, expected.SHA256)
 	}
-	config.MaxUploadSize = size
+	if _, err := hex.DecodeString(expected.MD5); err != nil || (expected.MD5 != "" && len(expected.MD5) != 2*md5.Size) {
+		return fileChecksums{}, fmt.Errorf("invalid %s value '%s'", expectedMD5Header, expected.MD5)
+	}
+	return expected, nil
+}
+
+// uploadFlag reads a boolean upload option from header, formField, or a query
+// parameter of the same name as formField.
+func uploadFlag(c *gin.Context, header, formField string) (bool, error) {
+	value := uploadOption(c, header, formField)
+	if value == "" {
+		value = c.Query(formField)
+	}
+	if value == "" {
+		return false, nil
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value '%s'", header, value)
+	}
+	return flag, nil
+}
+
+func uploadOption(c *gin.Context, header, formField string) string {
+	if value := strings.TrimSpace(c.GetHeader(header)); value != "" {
+		return value
+	}
+	if c.Request.Method == http.MethodPost {
+		return strings.TrimSpace(c.PostForm(formField))
+	}
+	return ""
+}
+
+// isNewDownload reports whether a request starts a download rather than
+// resuming one, so Range requests for later chunks do not use up Max-Downloads.
+// Only a single range starting past the first byte resumes a download. Suffix
+// ranges, several ranges and anything that cannot be parsed may cover the
+// start of the file, and with If-Range the whole file is sent when the
+// validator does not match, so all of those count.
+func isNewDownload(r *http.Request) bool {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") || r.Header.Get("If-Range") != "" {
+		return true
+	}
+	start, _, _ := strings.Cut(spec, "-")
+	offset, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	return err != nil || offset == 0
+}
+
+// getDeleteToken reads the delete token from the X-Delete-Token header, falling back to the token query parameter.
+func getDeleteToken(c *gin.Context) string {
+	if token := c.GetHeader(deleteTokenHeader); token != "" {
+		return token
+	}
+	return c.Query("token")
+}
+
+func handleGetMaxUploadSize(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"message":         "Max upload size updated",
-		"max_upload_size": config.MaxUploadSize,
+		"max_upload_size": currentConfig().MaxUploadSize,
 	})
 }
 
@@ -274,9 +1090,11 @@ func handleGetServerYear(c *gin.Context) {
 }
 
 func handleGetRetentionPolicy(c *gin.Context) {
+	cfg := currentConfig()
 	c.JSON(http.StatusOK, gin.H{
-		"retention_seconds": config.RetentionSeconds,
-		"storage_type":      config.StorageType,
-		"auto_cleanup":      true,
+		"retention_seconds":   cfg.RetentionSeconds,
+		"storage_type":        cfg.StorageType,
+		"auto_cleanup":        true,
+		"max_downloads_limit": cfg.MaxDownloadsLimit,
 	})
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postFiles sends a multipart POST with one file field per entry of sizes.
+func postFiles(t *testing.T, handler http.Handler, sizes ...int) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, size := range sizes {
+		part, err := mw.CreateFormFile("file", string(rune('a'+i))+".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(bytes.Repeat([]byte{'x'}, size))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("User-Agent", "curl/8.0")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadPostLimitsTotalSize(t *testing.T) {
+	storage := useMemoryStorage(t)
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxUploadSize = 1000 })
+	r, err := newRouter(currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		sizes      []int
+		wantStatus int
+	}{
+		{"files within the limit together", []int{400, 600}, http.StatusCreated},
+		{"files each within the limit", []int{600, 600}, http.StatusRequestEntityTooLarge},
+		{"body far beyond the limit", []int{multipartOverhead + 1000}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := storage.List(context.Background(), "")
+			w := postFiles(t, r, tt.sizes...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			after, _ := storage.List(context.Background(), "")
+			if tt.wantStatus != http.StatusCreated && len(after) != len(before) {
+				t.Errorf("refused upload stored %d objects", len(after)-len(before))
+			}
+		})
+	}
+}
+
+// testUpload is the part of the upload response the tests look at.
+type testUpload struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	DeleteToken string `json:"delete_token"`
+	path        string
+}
+
+func serveRequest(handler http.Handler, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// putTestFile uploads content as filename with PUT and returns the response.
+// The path field holds the download path of the file.
+func putTestFile(t *testing.T, handler http.Handler, filename, content string, header map[string]string) testUpload {
+	t.Helper()
+	w := serveRequest(handler, http.MethodPut, "/"+filename, header, content)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload %s: status %d, body %s", filename, w.Code, w.Body)
+	}
+	var upload testUpload
+	if err := json.Unmarshal(w.Body.Bytes(), &upload); err != nil {
+		t.Fatal(err)
+	}
+	fileURL, err := url.Parse(upload.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload.path = fileURL.Path
+	return upload
+}
+
+func newTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	r, err := newRouter(currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseUploadLimits(t *testing.T) {
+	useMemoryStorage(t)
+	useConfig(t, func(cfg *AppConfig) { cfg.RetentionSeconds = 7 * 24 * 3600 })
+	r := newTestRouter(t)
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{"fractional days", maxDaysHeader, "0.5", http.StatusCreated},
+		{"days beyond retention", maxDaysHeader, "1e300", http.StatusCreated},
+		{"zero days", maxDaysHeader, "0", http.StatusBadRequest},
+		{"negative days", maxDaysHeader, "-1", http.StatusBadRequest},
+		{"NaN days", maxDaysHeader, "NaN", http.StatusBadRequest},
+		{"infinite days", maxDaysHeader, "Inf", http.StatusBadRequest},
+		{"negative infinite days", maxDaysHeader, "-Inf", http.StatusBadRequest},
+		{"days not a number", maxDaysHeader, "week", http.StatusBadRequest},
+		{"downloads", maxDownloadsHeader, "3", http.StatusCreated},
+		{"zero downloads", maxDownloadsHeader, "0", http.StatusBadRequest},
+		{"negative downloads", maxDownloadsHeader, "-1", http.StatusBadRequest},
+		{"fractional downloads", maxDownloadsHeader, "1.5", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveRequest(r, http.MethodPut, "/notes.txt", map[string]string{tt.header: tt.value}, "hello")
+			if w.Code != tt.wantStatus {
+				t.Errorf("%s: %s: status %d, want %d", tt.header, tt.value, w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestIsNewDownload(t *testing.T) {
+	tests := []struct {
+		rangeHeader string
+		ifRange     string
+		want        bool
+	}{
+		{"", "", true},
+		{"bytes=0-", "", true},
+		{"bytes=0-99", "", true},
+		{"bytes=100-", "", false},
+		{"bytes=100-199", "", false},
+		{"bytes= 100-199", "", false},
+		{"bytes=-100", "", true},
+		{"bytes=100-199,0-99", "", true},
+		{"bytes=100-199,300-", "", true},
+		{"bytes=100-", `"etag"`, true},
+		{"bytes=x-", "", true},
+		{"items=100-", "", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		if tt.ifRange != "" {
+			req.Header.Set("If-Range", tt.ifRange)
+		}
+		if got := isNewDownload(req); got != tt.want {
+			t.Errorf("Range %q, If-Range %q: isNewDownload = %v, want %v", tt.rangeHeader, tt.ifRange, got, tt.want)
+		}
+	}
+}
+
+func TestMaxDownloads(t *testing.T) {
+	storage := useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "0123456789", map[string]string{maxDownloadsHeader: "2"})
+
+	steps := []struct {
+		name       string
+		target     string
+		rangeValue string
+		wantStatus int
+	}{
+		{"missing file", "/" + upload.ID + "/nope.txt", "", http.StatusNotFound},
+		{"first download", upload.path, "", http.StatusOK},
+		{"resumed download", upload.path, "bytes=5-", http.StatusPartialContent},
+		{"suffix range", upload.path, "bytes=-3", http.StatusPartialContent},
+		{"after the limit", upload.path, "", http.StatusGone},
+		{"resumed after the limit", upload.path, "bytes=5-", http.StatusGone},
+	}
+	for _, step := range steps {
+		header := map[string]string{}
+		if step.rangeValue != "" {
+			header["Range"] = step.rangeValue
+		}
+		if w := serveRequest(r, http.MethodGet, step.target, header, ""); w.Code != step.wantStatus {
+			t.Errorf("%s: status %d, want %d", step.name, w.Code, step.wantStatus)
+		}
+	}
+
+	// Files without a record cannot be held to a limit, so they are not served.
+	storage.Put(context.Background(), "mnopqrstuvwx/notes.txt", strings.NewReader("hello"))
+	if w := serveRequest(r, http.MethodGet, "/mnopqrstuvwx/notes.txt", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("file without a record: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// cancelingReader returns its content, then cancels the request it belongs
+// to, as a shutdown does to uploads still running once the drain timeout ends.
+type cancelingReader struct {
+	content io.Reader
+	cancel  context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		r.cancel()
+		return n, context.Canceled
+	}
+	return n, err
+}
+
+func TestCanceledUploadIsRemoved(t *testing.T) {
+	storage := useMemoryStorage(t)
+	r := newTestRouter(t)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"first.txt", "second.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 2048, Typeflag: tar.TypeReg})
+		tw.Write(bytes.Repeat([]byte{'x'}, 2048))
+	}
+	tw.Close()
+
+	// The first entry is stored in full before the request is cut off
+	// inside the second.
+	ctx, cancel := context.WithCancel(context.Background())
+	body := &cancelingReader{content: bytes.NewReader(archive.Bytes()[:3000]), cancel: cancel}
+	req := httptest.NewRequest(http.MethodPut, "/bundle.tar", body).WithContext(ctx)
+	req.Header.Set(extractHeader, "1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code == http.StatusCreated {
+		t.Error("canceled upload succeeded")
+	}
+	if objects, _ := storage.List(context.Background(), ""); len(objects) != 0 {
+		t.Errorf("canceled upload left %d objects behind", len(objects))
+	}
+}
+
+func TestFailedReplacementKeepsFile(t *testing.T) {
+	useMemoryStorage(t)
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxUploadSize = 100 })
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "original", nil)
+	target := "/" + upload.ID + "/notes.txt"
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		body       string
+		wantStatus int
+	}{
+		{"checksum mismatch", map[string]string{expectedMD5Header: strings.Repeat("0", 32)}, "replacement", http.StatusBadRequest},
+		{"too large", nil, strings.Repeat("x", 101), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{deleteTokenHeader: upload.DeleteToken}
+			for name, value := range tt.header {
+				header[name] = value
+			}
+			if w := serveRequest(r, http.MethodPut, target, header, tt.body); w.Code != tt.wantStatus {
+				t.Fatalf("replacement: status %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w := serveRequest(r, http.MethodGet, target, nil, ""); w.Code != http.StatusOK || w.Body.String() != "original" {
+				t.Errorf("after a failed replacement: status %d, body %q", w.Code, w.Body)
+			}
+			if w := serveRequest(r, http.MethodGet, target+"?info", nil, ""); !strings.Contains(w.Body.String(), `"size":8`) {
+				t.Errorf("record entry changed: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestDeleteRequiresToken(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", nil)
+	other := putTestFile(t, r, "other.txt", "hello", nil)
+	target := "/" + upload.ID + "/notes.txt"
+
+	tests := []struct {
+		name       string
+		target     string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"no token", target, nil, http.StatusForbidden},
+		{"wrong token", target, map[string]string{deleteTokenHeader: "wrong"}, http.StatusForbidden},
+		{"token of another upload", target + "?token=" + other.DeleteToken, nil, http.StatusForbidden},
+		{"unknown upload", "/mnopqrstuvwx/notes.txt", map[string]string{deleteTokenHeader: upload.DeleteToken}, http.StatusNotFound},
+		{"token in the header", target, map[string]string{deleteTokenHeader: upload.DeleteToken}, http.StatusOK},
+		{"file already deleted", target, map[string]string{deleteTokenHeader: upload.DeleteToken}, http.StatusNotFound},
+		{"whole upload with the token in the query", "/" + other.ID + "/?token=" + other.DeleteToken, nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(r, http.MethodDelete, tt.target, tt.header, ""); w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d, body %s", tt.name, w.Code, tt.wantStatus, w.Body)
+		}
+	}
+	if w := serveRequest(r, http.MethodGet, upload.path, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("download of a deleted file: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveRequest(r, http.MethodGet, other.path+"?info", nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("record of a deleted upload: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+const (
+	helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	helloMD5    = "5d41402abc4b2a76b9719d911017c592"
+)
+
+func TestUploadChecksums(t *testing.T) {
+	storage := useMemoryStorage(t)
+	r := newTestRouter(t)
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"no expectation", nil, http.StatusCreated},
+		{"expected SHA-256", map[string]string{expectedSHA256Header: strings.ToUpper(helloSHA256)}, http.StatusCreated},
+		{"expected MD5", map[string]string{expectedMD5Header: helloMD5}, http.StatusCreated},
+		{"wrong SHA-256", map[string]string{expectedSHA256Header: strings.Repeat("0", 64)}, http.StatusBadRequest},
+		{"wrong MD5", map[string]string{expectedSHA256Header: helloSHA256, expectedMD5Header: strings.Repeat("0", 32)}, http.StatusBadRequest},
+		{"malformed SHA-256", map[string]string{expectedSHA256Header: "abc"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := storage.List(context.Background(), "")
+			w := serveRequest(r, http.MethodPut, "/hello.txt", tt.header, "hello")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusCreated {
+				if after, _ := storage.List(context.Background(), ""); len(after) != len(before) {
+					t.Errorf("refused upload stored %d objects", len(after)-len(before))
+				}
+				return
+			}
+			var response struct{ SHA256, MD5 string }
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if response.SHA256 != helloSHA256 || response.MD5 != helloMD5 {
+				t.Errorf("response checksums %s and %s", response.SHA256, response.MD5)
+			}
+		})
+	}
+}
+
+func TestDownloadETag(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "hello.txt", "hello", nil)
+	etag := `"` + helloSHA256 + `"`
+
+	w := serveRequest(r, http.MethodGet, upload.path, nil, "")
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("ETag %q, want %q", w.Header().Get("ETag"), etag)
+	}
+	if want := "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=,md5=XUFAKrxLKna5cZ2REBfFkg=="; w.Header().Get("Digest") != want {
+		t.Errorf("Digest %q, want %q", w.Header().Get("Digest"), want)
+	}
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"If-None-Match with the ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"If-None-Match with the weak ETag", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"If-None-Match in a list", map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{"If-None-Match with another ETag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"If-Match with the ETag", map[string]string{"If-Match": etag}, http.StatusOK},
+		{"If-Match with another ETag", map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed},
+		{"If-Range with the ETag", map[string]string{"Range": "bytes=1-", "If-Range": etag}, http.StatusPartialContent},
+		{"If-Range with another ETag", map[string]string{"Range": "bytes=1-", "If-Range": `"other"`}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(r, http.MethodGet, upload.path, tt.header, ""); w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestEvaluateETagConditions(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+		// wantHeader lists the headers left for the backend to evaluate.
+		wantHeader []string
+	}{
+		{"none", nil, 0, nil},
+		{"If-None-Match matches", map[string]string{"If-None-Match": etag}, http.StatusNotModified, nil},
+		{"If-None-Match fails", map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": "Mon, 01 Jan 2024 00:00:00 GMT"}, 0, nil},
+		{"If-Match matches", map[string]string{"If-Match": etag}, 0, nil},
+		{"If-Match fails", map[string]string{"If-Match": `"xyz"`}, http.StatusPreconditionFailed, nil},
+		{"If-Match with a weak ETag", map[string]string{"If-Match": "W/" + etag}, http.StatusPreconditionFailed, nil},
+		{"If-Range matches", map[string]string{"Range": "bytes=1-", "If-Range": etag}, 0, []string{"Range"}},
+		{"If-Range fails", map[string]string{"Range": "bytes=1-", "If-Range": `"xyz"`}, 0, nil},
+		{"If-Modified-Since alone", map[string]string{"If-Modified-Since": "Mon, 01 Jan 2024 00:00:00 GMT"}, 0, []string{"If-Modified-Since"}},
+	}
+	for _, tt := range tests {
+		reqHeader := http.Header{}
+		for name, value := range tt.header {
+			reqHeader.Set(name, value)
+		}
+		resolved, status := evaluateETagConditions(reqHeader, etag)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.wantStatus)
+			continue
+		}
+		if status != 0 {
+			continue
+		}
+		var left []string
+		for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Range", "Range"} {
+			if resolved.Get(name) != "" {
+				left = append(left, name)
+			}
+		}
+		if strings.Join(left, ",") != strings.Join(tt.wantHeader, ",") {
+			t.Errorf("%s: headers left %v, want %v", tt.name, left, tt.wantHeader)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds the storage probe of a readiness check.
+const readinessTimeout = 5 * time.Second
+
+// cleanupStatus is what /readyz reports about the cleanup worker. Errors are
+// only logged, since the endpoint is public and they name storage paths.
+type cleanupStatus struct {
+	Enabled       bool       `json:"enabled"`
+	LastRun       *time.Time `json:"last_run,omitempty"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	LastRunFailed bool       `json:"last_run_failed"`
+}
+
+var (
+	cleanupStatusMu sync.Mutex
+	lastCleanup     cleanupStatus
+)
+
+// recordCleanupResult notes the outcome of a cleanup run; err is nil when the
+// run got through both the upload records and the storage backend.
+func recordCleanupResult(at time.Time, err error) {
+	cleanupStatusMu.Lock()
+	defer cleanupStatusMu.Unlock()
+	lastCleanup.Enabled = true
+	lastCleanup.LastRun = &at
+	lastCleanup.LastRunFailed = err != nil
+	if err == nil {
+		lastCleanup.LastSuccess = &at
+	}
+}
+
+func currentCleanupStatus() cleanupStatus {
+	cleanupStatusMu.Lock()
+	defer cleanupStatusMu.Unlock()
+	return lastCleanup
+}
+
+// handleHealthz answers GET /healthz. It only shows the process is serving
+// requests and touches nothing else.
+func handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz answers GET /readyz with 200 when the storage backend can take
+// uploads and 503 otherwise. The cleanup worker's state is reported but does
+// not affect readiness: a failed cleanup run leaves the service able to serve.
+func handleReadyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+	storageType := currentConfig().StorageType
+	storageState := gin.H{"type": storageType, "ok": true}
+	status, statusCode := "ready", http.StatusOK
+	if err := store.Ready(ctx); err != nil {
+		requestLogger(c).Warn("Readiness check failed", "storage", storageType, "error", err)
+		storageState["ok"] = false
+		status, statusCode = "not ready", http.StatusServiceUnavailable
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(statusCode, gin.H{
+		"status":  status,
+		"storage": storageState,
+		"cleanup": currentCleanupStatus(),
+	})
+}
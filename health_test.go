@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// unreadyStorage is a memoryStorage whose backend cannot be reached.
+type unreadyStorage struct {
+	*memoryStorage
+}
+
+func (unreadyStorage) Ready(context.Context) error {
+	return errors.New("backend unreachable")
+}
+
+// useCleanupStatus resets the reported cleanup status for the duration of
+// the test.
+func useCleanupStatus(t *testing.T) {
+	t.Helper()
+	cleanupStatusMu.Lock()
+	previous := lastCleanup
+	lastCleanup = cleanupStatus{}
+	cleanupStatusMu.Unlock()
+	t.Cleanup(func() {
+		cleanupStatusMu.Lock()
+		lastCleanup = previous
+		cleanupStatusMu.Unlock()
+	})
+}
+
+type readyzResponse struct {
+	Status  string `json:"status"`
+	Storage struct {
+		OK bool `json:"ok"`
+	} `json:"storage"`
+	Cleanup cleanupStatus `json:"cleanup"`
+}
+
+func getReadyz(t *testing.T, handler http.Handler) (int, readyzResponse) {
+	t.Helper()
+	w := serveRequest(handler, http.MethodGet, "/readyz", nil, "")
+	var body readyzResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %s: %v", w.Body, err)
+	}
+	return w.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	s := useMemoryStorage(t)
+	store = unreadyStorage{s}
+	handler := newTestRouter(t)
+	// Liveness does not depend on the storage backend.
+	if w := serveRequest(handler, http.MethodGet, "/healthz", nil, ""); w.Code != http.StatusOK {
+		t.Errorf("/healthz: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadyzFollowsStorage(t *testing.T) {
+	s := useMemoryStorage(t)
+	useCleanupStatus(t)
+	handler := newTestRouter(t)
+
+	if status, body := getReadyz(t, handler); status != http.StatusOK || body.Status != "ready" || !body.Storage.OK {
+		t.Errorf("with storage up: status %d, body %+v", status, body)
+	}
+	store = unreadyStorage{s}
+	if status, body := getReadyz(t, handler); status != http.StatusServiceUnavailable || body.Status != "not ready" || body.Storage.OK {
+		t.Errorf("with storage down: status %d, body %+v", status, body)
+	}
+}
+
+func TestReadyzReportsCleanup(t *testing.T) {
+	useMemoryStorage(t)
+	useCleanupStatus(t)
+	handler := newTestRouter(t)
+
+	if _, body := getReadyz(t, handler); body.Cleanup.Enabled || body.Cleanup.LastRun != nil {
+		t.Errorf("before any run: cleanup %+v", body.Cleanup)
+	}
+
+	succeeded := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	recordCleanupResult(succeeded, nil)
+	failed := succeeded.Add(time.Minute)
+	recordCleanupResult(failed, errors.New("listing failed"))
+
+	// A failed cleanup run is reported but leaves the service ready.
+	status, body := getReadyz(t, handler)
+	if status != http.StatusOK {
+		t.Errorf("after a failed cleanup run: status %d, want %d", status, http.StatusOK)
+	}
+	cleanup := body.Cleanup
+	if !cleanup.Enabled || !cleanup.LastRunFailed {
+		t.Errorf("cleanup %+v, want enabled with the last run failed", cleanup)
+	}
+	if cleanup.LastRun == nil || !cleanup.LastRun.Equal(failed) {
+		t.Errorf("last_run = %v, want %v", cleanup.LastRun, failed)
+	}
+	if cleanup.LastSuccess == nil || !cleanup.LastSuccess.Equal(succeeded) {
+		t.Errorf("last_success = %v, want %v", cleanup.LastSuccess, succeeded)
+	}
+
+	recordCleanupResult(failed.Add(time.Minute), nil)
+	if cleanup := currentCleanupStatus(); cleanup.LastRunFailed || !cleanup.LastSuccess.Equal(failed.Add(time.Minute)) {
+		t.Errorf("after a successful run: cleanup %+v", cleanup)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listedFile is one entry of a random ID listing.
+type listedFile struct {
+	Path        string    `json:"filepath"`
+	URL         string    `json:"url"`
+	Size        int64     `json:"size"`
+	ModifiedAt  time.Time `json:"modified_at"`
+	ContentType string    `json:"content_type,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	// Encrypted files can only be downloaded through the link returned at upload.
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"size": formatSize,
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 UTC") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Files in {{.ID}} - XTemp</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem auto; max-width: 60rem; padding: 0 1rem; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4rem .6rem; border-bottom: 1px solid #ddd; }
+td.num { text-align: right; white-space: nowrap; }
+p.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>Files in {{.ID}}</h1>
+<p class="meta">{{len .Files}} file(s), {{size .TotalSize}}{{if not .ExpiresAt.IsZero}}, expires {{time .ExpiresAt}}{{end}}</p>
+<table>
+<thead><tr><th>Name</th><th>Size</th><th>Modified</th></tr></thead>
+<tbody>
+{{range .Files}}<tr><td>{{if .Encrypted}}{{.Path}} (encrypted){{else}}<a href="{{.URL}}">{{.Path}}</a>{{end}}</td><td class="num">{{size .Size}}</td><td>{{time .ModifiedAt}}</td></tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// handleListFiles answers GET /:random_id/ with every file stored under the ID,
+// as HTML for browsers and JSON for everything else. Listing does not count as
+// a download.
+func handleListFiles(c *gin.Context, randomID string) {
+	meta, objects, ok := listUploadFiles(c, randomID, false)
+	if !ok {
+		return
+	}
+
+	bundleURL := fmt.Sprintf("%s/%s/", getBaseURL(c.Request), randomID)
+	// A listing opened through a signed link hands its signature on to the files.
+	signature := signedQuery(c)
+	files := make([]listedFile, 0, len(objects))
+	var totalSize int64
+	for _, obj := range objects {
+		userFilePath := strings.TrimPrefix(obj.Key, randomID+"/")
+		file := listedFile{
+			Path:       userFilePath,
+			URL:        bundleURL + url.PathEscape(userFilePath) + signature,
+			Size:       obj.Size,
+			ModifiedAt: obj.ModTime,
+		}
+		if meta != nil {
+			if recorded := meta.file(userFilePath); recorded != nil && recorded.encrypted() {
+				file.Encrypted = true
+			} else if recorded != nil {
+				file.ContentType = recorded.ContentType
+				file.SHA256 = recorded.SHA256
+			}
+		}
+		files = append(files, file)
+		totalSize += obj.Size
+	}
+	var expiresAt time.Time
+	if meta != nil {
+		expiresAt = meta.ExpiresAt
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		var page strings.Builder
+		err := listingTemplate.Execute(&page, struct {
+			ID        string
+			Files     []listedFile
+			TotalSize int64
+			ExpiresAt time.Time
+		}{randomID, files, totalSize, expiresAt})
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, "Error rendering file list", err)
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page.String()))
+		return
+	}
+	response := gin.H{
+		"id":         randomID,
+		"bundle_url": bundleURL + signature,
+		"files":      files,
+		"total_size": totalSize,
+	}
+	if meta != nil {
+		response["expires_at"] = meta.ExpiresAt
+		response["max_downloads"] = meta.MaxDownloads
+		response["downloads"] = meta.Downloads
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// listUploadFiles returns the record of randomID, if any, and every object
+// stored under it sorted by key and dated by the record where it lists one. If
+// count is set, the request is recorded as a download. It writes the error
+// response itself.
+func listUploadFiles(c *gin.Context, randomID string, count bool) (*uploadMetadata, []ObjectInfo, bool) {
+	if _, err := buildAndVerifyStoragePath(randomID, "."); err != nil {
+		abortWithError(c, http.StatusBadRequest, "Error accessing file path", err)
+		return nil, nil, false
+	}
+	meta, err := claimDownload(c.Request.Context(), randomID, count)
+	if errors.Is(err, errUploadExpired) || errors.Is(err, errDownloadLimitReached) {
+		abortWithError(c, http.StatusGone, "Files are no longer available", err)
+		return nil, nil, false
+	} else if errors.Is(err, errUploadIncomplete) || errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "No files found", err)
+		return nil, nil, false
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return nil, nil, false
+	}
+	objects, err := store.List(c.Request.Context(), randomID+"/")
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error listing files", err)
+		return nil, nil, false
+	}
+	if len(objects) == 0 {
+		abortWithError(c, http.StatusNotFound, "No files found", nil)
+		return nil, nil, false
+	}
+	for i := range objects {
+		objects[i].ModTime = uploadedAt(meta, strings.TrimPrefix(objects[i].Key, randomID+"/"), objects[i].ModTime)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return meta, objects, true
+}
+
+// formatSize renders a byte count for people, e.g. "1.5 MB".
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
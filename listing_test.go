@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListFiles(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "b.txt", "hello", map[string]string{maxDownloadsHeader: "1"})
+	if w := serveRequest(r, http.MethodPut, "/"+upload.ID+"/a.txt", map[string]string{deleteTokenHeader: upload.DeleteToken}, "hi"); w.Code != http.StatusCreated {
+		t.Fatalf("adding a file: status %d, body %s", w.Code, w.Body)
+	}
+	listingPath := "/" + upload.ID + "/"
+
+	w := serveRequest(r, http.MethodGet, listingPath, map[string]string{"Accept": "application/json"}, "")
+	var listing struct {
+		ID        string       `json:"id"`
+		Files     []listedFile `json:"files"`
+		TotalSize int64        `json:"total_size"`
+		Downloads int64        `json:"downloads"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("JSON listing: status %d, body %s", w.Code, w.Body)
+	}
+	if listing.ID != upload.ID || listing.TotalSize != 7 || len(listing.Files) != 2 {
+		t.Fatalf("listing: %+v", listing)
+	}
+	for i, want := range []struct {
+		path string
+		size int64
+	}{{"a.txt", 2}, {"b.txt", 5}} {
+		file := listing.Files[i]
+		if file.Path != want.path || file.Size != want.size || !strings.HasSuffix(file.URL, listingPath+want.path) || file.ContentType == "" || file.ModifiedAt.IsZero() {
+			t.Errorf("file %d: %+v, want %s with %d bytes", i, file, want.path, want.size)
+		}
+	}
+
+	w = serveRequest(r, http.MethodGet, listingPath, map[string]string{"Accept": "text/html"}, "")
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+		!strings.Contains(body, `href="`+listing.Files[0].URL+`"`) || !strings.Contains(body, "b.txt") {
+		t.Errorf("HTML listing: status %d, Content-Type %q, body %s", w.Code, w.Header().Get("Content-Type"), body)
+	}
+
+	// Listing does not count as a download.
+	if w := serveRequest(r, http.MethodGet, upload.path, nil, ""); w.Code != http.StatusOK {
+		t.Errorf("download after listing: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestListFilesErrors(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", nil)
+	serveRequest(r, http.MethodDelete, "/"+upload.ID+"/notes.txt", map[string]string{deleteTokenHeader: upload.DeleteToken}, "")
+
+	tests := []struct {
+		name, target string
+		wantStatus   int
+	}{
+		{"unknown ID", "/mnopqrstuvwx/", http.StatusNotFound},
+		{"every file deleted", "/" + upload.ID + "/", http.StatusNotFound},
+		{"invalid ID", "/mnop.qrst/", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(r, http.MethodGet, tt.target, nil, ""); w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validRequestID limits the request IDs accepted from clients or proxies, so a
+// forged header cannot inject anything odd into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newLogger builds the process logger from XTEMP_LOG_FORMAT (text or json) and
+// XTEMP_LOG_LEVEL (debug, info, warn or error). It also becomes the slog and
+// log package default, so output from libraries ends up in the same stream.
+func newLogger(format, levelStr string) *slog.Logger {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(levelStr))
+	if levelStr == "" || levelErr != nil {
+		level = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	default:
+		handler = slog.NewTextHandler(os.Stdout, options)
+	}
+	l := slog.New(handler)
+	slog.SetDefault(l)
+	if levelStr != "" && levelErr != nil {
+		l.Warn("Invalid log level, using info", "env", envLogLevel, "value", levelStr)
+	}
+	if f := strings.ToLower(strings.TrimSpace(format)); f != "" && f != "json" && f != "text" {
+		l.Warn("Invalid log format, using text", "env", envLogFormat, "value", format)
+	}
+	return l
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestLoggerKey struct{}
+
+// requestIDKey is the gin context key holding the request ID.
+const requestIDKey = "request_id"
+
+// loggerFrom returns the logger of the request behind ctx, which carries its
+// request ID, or the process logger outside of requests.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// requestLogger returns the logger of the current request.
+func requestLogger(c *gin.Context) *slog.Logger {
+	return loggerFrom(c.Request.Context())
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// assignRequestID tags the request with the X-Request-Id it came with, or a
+// new one, echoes it in the response and attaches a logger carrying it to the
+// request context.
+func assignRequestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	l := logger.With("request_id", id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestLoggerKey{}, l))
+	c.Next()
+}
+
+// logRequests writes one access log line per request. The query string is left
+// out since it can carry passwords and URL signatures, and the path goes
+// through loggablePath to drop decryption keys and delete tokens. Successful
+// probes log at debug level so frequent health checks do not flood the log.
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	} else if status == http.StatusOK && (c.FullPath() == "/healthz" || c.FullPath() == "/readyz") {
+		level = slog.LevelDebug
+	}
+	requestLogger(c).Log(c.Request.Context(), level, "Request handled",
+		"method", c.Request.Method,
+		"path", loggablePath(c),
+		"status", status,
+		"bytes", max(c.Writer.Size(), 0),
+		"duration_ms", float64(time.Since(start).Microseconds())/1000,
+		"ip", c.ClientIP(),
+	)
+}
+
+// redactedSecret replaces secrets removed from logged paths.
+const redactedSecret = "REDACTED"
+
+// loggablePath returns the request path with the secret that may follow the
+// random ID removed: the decryption key of an encrypted file, or the delete
+// token in a tus upload URL. The ID segment comes first, or second on routes
+// that prefix it, such as /sign/ and /files/.
+func loggablePath(c *gin.Context) string {
+	segments := strings.SplitN(c.Request.URL.Path, "/", 4)
+	i := 1
+	if len(segments) > 2 && (segments[1] == "sign" || "/"+segments[1]+"/" == tusEndpoint) {
+		i = 2
+	}
+	if i < len(segments) {
+		if randomID, _, found := strings.Cut(segments[i], encryptionKeySeparator); found {
+			segments[i] = randomID + encryptionKeySeparator + redactedSecret
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// recoverPanics turns a panic in a handler into a 500 and logs it with its stack.
+var recoverPanics = gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+	requestLogger(c).Error("Panic while handling request", "panic", recovered, "stack", string(debug.Stack()))
+	c.AbortWithStatus(http.StatusInternalServerError)
+})
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the process log to a buffer as JSON for the duration of
+// the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := logger
+	logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { logger = previous })
+	return &buf
+}
+
+func TestRequestID(t *testing.T) {
+	useMemoryStorage(t)
+	handler := newTestRouter(t)
+	tests := []struct {
+		name, incoming string
+		wantIncoming   bool
+	}{
+		{"none", "", false},
+		{"valid", "edge-1.abc:42", true},
+		{"with spaces", "bad id", false},
+		{"with a newline", "id\nlevel=ERROR", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{"Accept": "application/json"}
+			if tt.incoming != "" {
+				header[requestIDHeader] = tt.incoming
+			}
+			w := serveRequest(handler, http.MethodGet, "/abcdefghijkl/missing.txt", header, "")
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusNotFound)
+			}
+			id := w.Header().Get(requestIDHeader)
+			if tt.wantIncoming && id != tt.incoming {
+				t.Errorf("%s = %q, want the incoming %q", requestIDHeader, id, tt.incoming)
+			}
+			if !tt.wantIncoming && (id == tt.incoming || !validRequestID.MatchString(id)) {
+				t.Errorf("%s = %q, want a new ID", requestIDHeader, id)
+			}
+			var body struct {
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.RequestID != id {
+				t.Errorf("request_id in error body = %q, want %q", body.RequestID, id)
+			}
+		})
+	}
+}
+
+func TestRequestLogsCarryIDWithoutSecrets(t *testing.T) {
+	useMemoryStorage(t)
+	handler := newTestRouter(t)
+	logs := captureLogs(t)
+	header := map[string]string{requestIDHeader: "trace-7"}
+	serveRequest(handler, http.MethodGet, "/abcdefghijkl_s3cretkey/notes.txt?password=hunter2&sig=deadbeef", header, "")
+
+	var lines int
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines++
+		if entry["request_id"] != "trace-7" {
+			t.Errorf("log line %q has request_id %v, want trace-7", entry["msg"], entry["request_id"])
+		}
+	}
+	if lines == 0 {
+		t.Fatal("nothing was logged")
+	}
+	for _, secret := range []string{"s3cretkey", "hunter2", "deadbeef"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("log contains %q:\n%s", secret, logs)
+		}
+	}
+	if !strings.Contains(logs.String(), "/abcdefghijkl_"+redactedSecret+"/notes.txt") {
+		t.Errorf("log does not show the redacted path:\n%s", logs)
+	}
+}
+
+func TestLoggablePath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/abcdefghijkl/notes.txt", "/abcdefghijkl/notes.txt"},
+		{"/abcdefghijkl/my_notes.txt", "/abcdefghijkl/my_notes.txt"},
+		{"/abcdefghijkl_key/notes.txt", "/abcdefghijkl_REDACTED/notes.txt"},
+		{"/abcdefghijkl_key", "/abcdefghijkl_REDACTED"},
+		{"/sign/abcdefghijkl_key/notes.txt", "/sign/abcdefghijkl_REDACTED/notes.txt"},
+		{tusEndpoint + "abcdefghijkl_token", tusEndpoint + "abcdefghijkl_REDACTED"},
+		{"/", "/"},
+	}
+	for _, tt := range tests {
+		c, _ := newTestContext(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got := loggablePath(c); got != tt.want {
+			t.Errorf("loggablePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMain keeps test output to failures unless -v is given.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	gin.SetMode(gin.TestMode)
+	if !testing.Verbose() {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	os.Exit(m.Run())
+}
+
+// useConfig applies change to a copy of the current configuration for the
+// duration of the test.
+func useConfig(t *testing.T, change func(cfg *AppConfig)) {
+	t.Helper()
+	previous := currentConfig()
+	cfg := *previous
+	change(&cfg)
+	activeConfig.Store(&cfg)
+	t.Cleanup(func() { activeConfig.Store(previous) })
+}
+
+// newTestContext returns a gin context for req whose response is recorded.
+func newTestContext(req *http.Request) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	return c, w
+}
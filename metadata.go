@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metadataPrefix = internalPrefix + "meta/"
+
+var (
+	errUploadExpired        = errors.New("upload has expired")
+	errDownloadLimitReached = errors.New("download limit reached")
+	errUploadIncomplete     = errors.New("upload is still in progress")
+)
+
+// metadataLocks serializes read-modify-write cycles on a single record, such
+// as download counting. It only covers this process.
+var metadataLocks sync.Map
+
+// uploadMetadata is the record kept alongside every random ID. It lives under
+// internalPrefix in the configured Storage so it survives restarts on every backend.
+type uploadMetadata struct {
+	ID              string `json:"id"`
+	DeleteTokenHash string `json:"delete_token_hash"`
+	UploaderIP      string `json:"uploader_ip"`
+	// APIKey names the API key the upload was made with, if any.
+	APIKey       string    `json:"api_key,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxDownloads int64     `json:"max_downloads,omitempty"`
+	Downloads    int64     `json:"downloads"`
+	// PasswordHash is the bcrypt hash of the download password, if any.
+	PasswordHash string         `json:"password_hash,omitempty"`
+	Files        []fileMetadata `json:"files"`
+	// Resumable is set for uploads created through the tus endpoint.
+	Resumable *ChunkedUpload `json:"resumable,omitempty"`
+}
+
+// fileMetadata describes one file stored under a random ID.
+type fileMetadata struct {
+	Path             string    `json:"path"`
+	OriginalFilename string    `json:"original_filename"`
+	ContentType      string    `json:"content_type"`
+	Size             int64     `json:"size"`
+	SHA256           string    `json:"sha256"`
+	MD5              string    `json:"md5,omitempty"`
+	UploadedAt       time.Time `json:"uploaded_at"`
+	// KeyHash is set for encrypted files. The key itself is never stored; Key
+	// only carries it from the upload to the response.
+	KeyHash string `json:"key_hash,omitempty"`
+	Key     []byte `json:"-"`
+}
+
+func (file *fileMetadata) encrypted() bool {
+	return file.KeyHash != ""
+}
+
+// file returns the entry for userFilePath, or nil if the record does not list it.
+func (meta *uploadMetadata) file(userFilePath string) *fileMetadata {
+	for i := range meta.Files {
+		if meta.Files[i].Path == userFilePath {
+			return &meta.Files[i]
+		}
+	}
+	return nil
+}
+
+// uploadedAt returns when userFilePath was uploaded according to meta, or
+// stored when the record does not say. The record is preferred because a
+// deduplicated file shares its modification time with every link to its blob.
+func uploadedAt(meta *uploadMetadata, userFilePath string, stored time.Time) time.Time {
+	if meta != nil {
+		if file := meta.file(userFilePath); file != nil && !file.UploadedAt.IsZero() {
+			return file.UploadedAt
+		}
+	}
+	return stored
+}
+
+// mergeFiles adds added to files, replacing entries with the same path.
+func mergeFiles(files, added []fileMetadata) []fileMetadata {
+	for _, file := range added {
+		replaced := false
+		for i := range files {
+			if files[i].Path == file.Path {
+				files[i] = file
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// removeFile drops the entry for userFilePath from files.
+func removeFile(files []fileMetadata, userFilePath string) []fileMetadata {
+	kept := files[:0]
+	for _, file := range files {
+		if file.Path != userFilePath {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+func metadataKey(randomID string) string {
+	return metadataPrefix + randomID + ".json"
+}
+
+func hashDeleteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkDeleteToken reports whether token matches the hash stored in meta.
+func (meta *uploadMetadata) checkDeleteToken(token string) bool {
+	if token == "" || meta.DeleteTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(meta.DeleteTokenHash)) == 1
+}
+
+// available returns errUploadExpired or errDownloadLimitReached once the upload
+// may no longer be downloaded, and errUploadIncomplete while a resumable upload
+// is still receiving data.
+func (meta *uploadMetadata) available(now time.Time) error {
+	if !meta.ExpiresAt.IsZero() && !now.Before(meta.ExpiresAt) {
+		return errUploadExpired
+	}
+	if meta.Resumable != nil && !meta.Resumable.complete() {
+		return errUploadIncomplete
+	}
+	if meta.MaxDownloads > 0 && meta.Downloads >= meta.MaxDownloads {
+		return errDownloadLimitReached
+	}
+	return nil
+}
+
+func lockMetadata(randomID string) func() {
+	mu, _ := metadataLocks.LoadOrStore(randomID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// claimDownload checks that randomID can still be downloaded and, if count is
+// set, records one more download. It returns the upload record. Files without
+// a record are refused with ErrObjectNotFound: they are still being stored or
+// their record was lost, and either way Max-Downloads could not be enforced.
+func claimDownload(ctx context.Context, randomID string, count bool) (*uploadMetadata, error) {
+	meta, err := loadMetadata(ctx, randomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := meta.available(time.Now()); err != nil || !count {
+		return meta, err
+	}
+	return countDownload(ctx, randomID)
+}
+
+// countDownload records one more download of randomID if it is still
+// available, and returns the updated record.
+func countDownload(ctx context.Context, randomID string) (*uploadMetadata, error) {
+	// Callers check that the record exists before locking, so requests for
+	// unknown IDs cannot grow metadataLocks.
+	unlock := lockMetadata(randomID)
+	defer unlock()
+	meta, err := loadMetadata(ctx, randomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := meta.available(time.Now()); err != nil {
+		return nil, err
+	}
+	meta.Downloads++
+	return meta, saveMetadata(ctx, meta)
+}
+
+// forgetFile drops userFilePath from the record of randomID after the file was deleted.
+func forgetFile(ctx context.Context, randomID, userFilePath string) error {
+	unlock := lockMetadata(randomID)
+	defer unlock()
+	meta, err := loadMetadata(ctx, randomID)
+	if err != nil {
+		return err
+	}
+	meta.Files = removeFile(meta.Files, userFilePath)
+	return saveMetadata(ctx, meta)
+}
+
+// expireUploads removes every upload whose record says it has expired or used
+// up its downloads, together with the record itself, and adds what it removed
+// or failed to remove to stats.
+func expireUploads(ctx context.Context, stats *cleanupStats) error {
+	records, err := store.List(ctx, metadataPrefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		randomID := strings.TrimSuffix(strings.TrimPrefix(record.Key, metadataPrefix), ".json")
+		meta, err := loadMetadata(ctx, randomID)
+		if err != nil {
+			logger.Error("Metadata cleanup: failed to load record", "key", record.Key, "error", err)
+			stats.Failed++
+			continue
+		}
+		reason := meta.available(now)
+		if reason == nil || errors.Is(reason, errUploadIncomplete) {
+			continue
+		}
+		if meta.Resumable != nil && !meta.Resumable.complete() {
+			if chunked, ok := store.(chunkedStorage); ok {
+				if err := chunked.AbortChunked(ctx, meta.Resumable); err != nil {
+					logger.Error("Metadata cleanup: failed to abort unfinished upload", "id", randomID, "error", err)
+				}
+			}
+		}
+		if err := store.DeletePrefix(ctx, randomID+"/"); err != nil && !errors.Is(err, ErrObjectNotFound) {
+			logger.Error("Metadata cleanup: failed to delete upload", "id", randomID, "error", err)
+			stats.Failed++
+			continue
+		}
+		if err := deleteMetadata(ctx, randomID); err != nil {
+			logger.Error("Metadata cleanup: failed to delete record", "key", record.Key, "error", err)
+			stats.Failed++
+			continue
+		}
+		stats.Deleted += len(meta.Files)
+		metadataLocks.Delete(randomID)
+		logger.Info("Metadata cleanup: removed upload", "id", randomID, "reason", reason)
+	}
+	return nil
+}
+
+func loadMetadata(ctx context.Context, randomID string) (*uploadMetadata, error) {
+	content, _, err := store.Get(ctx, metadataKey(randomID))
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata for %s: %w", randomID, err)
+	}
+	meta := &uploadMetadata{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata for %s: %w", randomID, err)
+	}
+	return meta, nil
+}
+
+func saveMetadata(ctx context.Context, meta *uploadMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata for %s: %w", meta.ID, err)
+	}
+	if _, err := store.Put(ctx, metadataKey(meta.ID), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to store metadata for %s: %w", meta.ID, err)
+	}
+	trackKeyUsage(meta)
+	return nil
+}
+
+func deleteMetadata(ctx context.Context, randomID string) error {
+	if err := store.Delete(ctx, metadataKey(randomID)); err != nil {
+		return err
+	}
+	untrackKeyUsage(randomID)
+	return nil
+}
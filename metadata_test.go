@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUploadRecord(t *testing.T) {
+	storage := useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", nil)
+	added := serveRequest(r, http.MethodPut, "/"+upload.ID+"/more.txt", map[string]string{deleteTokenHeader: upload.DeleteToken}, "hello again")
+	if added.Code != http.StatusCreated {
+		t.Fatalf("adding a file: status %d, body %s", added.Code, added.Body)
+	}
+
+	meta, err := loadMetadata(context.Background(), upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != upload.ID || meta.UploaderIP == "" || meta.CreatedAt.IsZero() || !meta.ExpiresAt.After(meta.CreatedAt) {
+		t.Errorf("record: %+v", meta)
+	}
+	if !meta.checkDeleteToken(upload.DeleteToken) {
+		t.Error("record does not accept the delete token")
+	}
+	stored, _, err := storage.Get(context.Background(), metadataKey(upload.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	var raw strings.Builder
+	io.Copy(&raw, stored)
+	if strings.Contains(raw.String(), upload.DeleteToken) {
+		t.Error("record holds the delete token in the clear")
+	}
+	if len(meta.Files) != 2 || meta.file("notes.txt") == nil || meta.file("more.txt") == nil {
+		t.Fatalf("record files: %+v", meta.Files)
+	}
+	if file := meta.file("more.txt"); file.Size != 11 || file.SHA256 == "" || file.OriginalFilename != "more.txt" {
+		t.Errorf("record of more.txt: %+v", file)
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", map[string]string{maxDownloadsHeader: "3"})
+
+	tests := []struct {
+		target     string
+		wantStatus int
+	}{
+		{upload.path + "?info", http.StatusOK},
+		{"/" + upload.ID + "/nope.txt?info", http.StatusNotFound},
+		{"/mnopqrstuvwx/notes.txt?info", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(r, http.MethodGet, tt.target, nil, ""); w.Code != tt.wantStatus {
+			t.Errorf("GET %s: status %d, want %d", tt.target, w.Code, tt.wantStatus)
+		}
+	}
+
+	w := serveRequest(r, http.MethodGet, upload.path+"?info", nil, "")
+	var info map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"id":                upload.ID,
+		"filepath":          "notes.txt",
+		"original_filename": "notes.txt",
+		"size":              float64(5),
+		"sha256":            "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"max_downloads":     float64(3),
+		"downloads":         float64(0),
+		"available":         true,
+	}
+	for field, value := range want {
+		if info[field] != value {
+			t.Errorf("%s = %v, want %v", field, info[field], value)
+		}
+	}
+	if _, ok := info["delete_token_hash"]; ok {
+		t.Error("info shows the delete token hash")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A small implementation of the Prometheus text exposition format, enough for
+// the counters, gauges and histograms below.
+
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+// durationBuckets are the histogram bounds, in seconds, for request and
+// cleanup durations.
+var durationBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// metricVec is one metric family, with one series per combination of label values.
+type metricVec struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// Histograms only: observations per bucket (not cumulative) and their count.
+	bucketCounts []uint64
+	count        uint64
+}
+
+var metricRegistry []*metricVec
+
+func newMetric(kind metricKind, name, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+	if kind == metricHistogram {
+		m.buckets = durationBuckets
+	}
+	metricRegistry = append(metricRegistry, m)
+	return m
+}
+
+func (m *metricVec) with(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if m.kind == metricHistogram {
+			s.bucketCounts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add increases a counter, or a gauge, by delta.
+func (m *metricVec) add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value += delta
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// set replaces the value of a gauge.
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value = value
+}
+
+// observe records one histogram observation.
+func (m *metricVec) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.with(labelValues)
+	s.value += value
+	s.count++
+	if i, _ := slices.BinarySearch(m.buckets, value); i < len(m.buckets) {
+		s.bucketCounts[i]++
+	}
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.bucketCounts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatMetricValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels renders {name="value",...}, with an extra label appended when
+// extraName is set.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricUploads = newMetric(metricCounter, "xtemp_uploads_total",
+		"Successful uploads. A resumable upload counts once, when its last chunk arrives.", "method", "storage")
+	metricUploadDuration = newMetric(metricHistogram, "xtemp_upload_duration_seconds",
+		"Time taken by upload requests, successful or not.", "method", "storage")
+	metricBytesIn = newMetric(metricCounter, "xtemp_upload_bytes_total",
+		"Request body bytes received by upload requests.", "method", "storage")
+	metricDownloads = newMetric(metricCounter, "xtemp_downloads_total",
+		"Successful download requests, including listings and archives.", "method", "storage")
+	metricDownloadDuration = newMetric(metricHistogram, "xtemp_download_duration_seconds",
+		"Time taken by download requests, successful or not.", "method", "storage")
+	metricBytesOut = newMetric(metricCounter, "xtemp_download_bytes_total",
+		"Response body bytes sent by successful download requests.", "method", "storage")
+	metricErrors = newMetric(metricCounter, "xtemp_errors_total",
+		"Error responses, by status class and code.", "class", "code")
+	metricCleanupRuns = newMetric(metricCounter, "xtemp_cleanup_runs_total",
+		"Cleanup worker runs.", "storage")
+	metricCleanupDeleted = newMetric(metricCounter, "xtemp_cleanup_deleted_objects_total",
+		"Files and objects removed by the cleanup worker.", "storage")
+	metricCleanupFailures = newMetric(metricCounter, "xtemp_cleanup_failures_total",
+		"Removals or scans the cleanup worker could not complete.", "storage")
+	metricCleanupDuration = newMetric(metricHistogram, "xtemp_cleanup_duration_seconds",
+		"Time taken by cleanup worker runs.", "storage")
+	metricStoredBytes = newMetric(metricGauge, "xtemp_stored_bytes",
+		"Bytes of uploaded files held in storage, as of the last cleanup run.", "storage")
+	metricStoredFiles = newMetric(metricGauge, "xtemp_stored_files",
+		"Uploaded files held in storage, as of the last cleanup run.", "storage")
+)
+
+// recordError counts an error response sent by abortWithError.
+func recordError(statusCode int) {
+	metricErrors.inc(strconv.Itoa(statusCode/100)+"xx", strconv.Itoa(statusCode))
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// instrumentUploads records count, duration and bytes received of the upload
+// requests it wraps.
+func instrumentUploads(c *gin.Context) {
+	instrumentUploadRequest(c, true)
+}
+
+// instrumentChunks records duration and bytes received of the chunks of
+// resumable uploads. The handler counts the upload once, when it completes.
+func instrumentChunks(c *gin.Context) {
+	instrumentUploadRequest(c, false)
+}
+
+func instrumentUploadRequest(c *gin.Context, count bool) {
+	start := time.Now()
+	body := &countingBody{ReadCloser: c.Request.Body}
+	c.Request.Body = body
+	c.Next()
+	storage := string(currentConfig().StorageType)
+	metricUploadDuration.observe(time.Since(start).Seconds(), c.Request.Method, storage)
+	metricBytesIn.add(float64(body.n), c.Request.Method, storage)
+	if count && c.Writer.Status() < http.StatusBadRequest {
+		recordUpload(c)
+	}
+}
+
+// recordUpload counts one successful upload made by the current request.
+func recordUpload(c *gin.Context) {
+	metricUploads.inc(c.Request.Method, string(currentConfig().StorageType))
+}
+
+// instrumentDownloads records count, duration and bytes sent of the download
+// requests it wraps.
+func instrumentDownloads(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	storage := string(currentConfig().StorageType)
+	metricDownloadDuration.observe(time.Since(start).Seconds(), c.Request.Method, storage)
+	if c.Writer.Status() < http.StatusBadRequest {
+		metricDownloads.inc(c.Request.Method, storage)
+		metricBytesOut.add(float64(max(c.Writer.Size(), 0)), c.Request.Method, storage)
+	}
+}
+
+// recordCleanup updates the cleanup metrics after a run of the cleanup worker.
+func recordCleanup(storage StorageType, stats cleanupStats, duration time.Duration) {
+	metricCleanupRuns.inc(string(storage))
+	metricCleanupDeleted.add(float64(stats.Deleted), string(storage))
+	metricCleanupFailures.add(float64(stats.Failed), string(storage))
+	metricCleanupDuration.observe(duration.Seconds(), string(storage))
+	metricStoredBytes.set(float64(stats.StoredBytes), string(storage))
+	metricStoredFiles.set(float64(stats.StoredFiles), string(storage))
+}
+
+// handleMetrics answers GET /metrics in the Prometheus text format.
+func handleMetrics(c *gin.Context) {
+	var out strings.Builder
+	for _, m := range metricRegistry {
+		m.write(&out)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(out.String()))
+}
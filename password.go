@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// passwordAttemptLimit wrong passwords per client and upload are allowed
+	// within passwordAttemptWindow before further attempts are refused.
+	passwordAttemptLimit  = 5
+	passwordAttemptWindow = 5 * time.Minute
+	// maxPasswordLength is the most bcrypt can hash.
+	maxPasswordLength = 72
+	// passwordCookiePrefix names the cookie that remembers a password entered
+	// in the browser form, followed by the random ID it unlocks.
+	passwordCookiePrefix = "xtemp_unlock_"
+)
+
+// passwordCookieSecret signs unlock cookies. It is regenerated on every start,
+// which only means browsers have to enter the password again.
+var passwordCookieSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("failed to generate password cookie secret: " + err.Error())
+	}
+	return secret
+}()
+
+var passwordFormTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Password required - XTemp</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 4rem auto; max-width: 24rem; padding: 0 1rem; color: #222; }
+input { font-size: 1rem; padding: .4rem; width: 100%; box-sizing: border-box; margin: .5rem 0; }
+p.error { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>Password required</h1>
+<p>This upload is protected. Enter the password you were given to continue.</p>
+{{if .Failed}}<p class="error">Wrong password, please try again.</p>{{end}}
+<form method="post">
+<input type="password" name="password" autofocus required>
+<input type="submit" value="Download">
+</form>
+</body>
+</html>
+`))
+
+// hashDownloadPassword returns the salted bcrypt hash kept in the upload record.
+func hashDownloadPassword(password string) (string, error) {
+	if len(password) > maxPasswordLength {
+		return "", errors.New("download password is longer than 72 bytes")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// passwordAttempts counts recent wrong passwords per client and upload.
+type passwordAttempts struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+var downloadPasswordAttempts = &passwordAttempts{failures: make(map[string][]time.Time)}
+
+// retryAfter returns how long key must wait before trying again, or zero if
+// it may try now.
+func (a *passwordAttempts) retryAfter(key string, now time.Time) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recent := a.prune(key, now)
+	if len(recent) < passwordAttemptLimit {
+		return 0
+	}
+	return recent[0].Add(passwordAttemptWindow).Sub(now)
+}
+
+func (a *passwordAttempts) fail(key string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures[key] = append(a.prune(key, now), now)
+	// Drop clients that have gone quiet so the map does not grow without bound.
+	for other := range a.failures {
+		a.prune(other, now)
+	}
+}
+
+func (a *passwordAttempts) prune(key string, now time.Time) []time.Time {
+	recent := a.failures[key]
+	for len(recent) > 0 && now.Sub(recent[0]) >= passwordAttemptWindow {
+		recent = recent[1:]
+	}
+	if len(recent) == 0 {
+		delete(a.failures, key)
+		return nil
+	}
+	a.failures[key] = recent
+	return recent
+}
+
+// passwordCookieValue is the unlock cookie for randomID. It changes with the
+// password hash, so it never outlives the upload it was issued for.
+func passwordCookieValue(randomID, passwordHash string) string {
+	mac := hmac.New(sha256.New, passwordCookieSecret)
+	mac.Write([]byte(randomID + "\x00" + passwordHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hasPasswordCookie(c *gin.Context, randomID, passwordHash string) bool {
+	cookie, err := c.Cookie(passwordCookiePrefix + randomID)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(cookie), []byte(passwordCookieValue(randomID, passwordHash)))
+}
+
+// providedDownloadPassword reads a download password from basic auth, the
+// X-Download-Password header, the password query parameter, or the browser form.
+func providedDownloadPassword(c *gin.Context) (string, bool) {
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		return password, true
+	}
+	if password := c.GetHeader(downloadPasswordHeader); password != "" {
+		return password, true
+	}
+	if password, ok := c.GetQuery("password"); ok {
+		return password, true
+	}
+	if c.Request.Method == http.MethodPost {
+		if password, ok := c.GetPostForm("password"); ok {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+// checkDownloadPassword lets the request through if randomID has no download
+// password or the request carries the right one. A password entered in the
+// browser form also sets a cookie, so the browser can follow links under the
+// ID without asking again. Otherwise it answers with that form for browsers,
+// a basic auth challenge for everything else, or 429 once too many wrong
+// passwords were tried.
+func checkDownloadPassword(c *gin.Context, randomID string) bool {
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		return true
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return false
+	}
+	if meta.PasswordHash == "" || hasPasswordCookie(c, randomID, meta.PasswordHash) {
+		return true
+	}
+	attemptKey := c.ClientIP() + "/" + randomID
+	now := time.Now()
+	if wait := downloadPasswordAttempts.retryAfter(attemptKey, now); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		abortWithError(c, http.StatusTooManyRequests, "Too many wrong passwords, try again later", nil)
+		return false
+	}
+	password, provided := providedDownloadPassword(c)
+	if provided {
+		if bcrypt.CompareHashAndPassword([]byte(meta.PasswordHash), []byte(password)) == nil {
+			if c.Request.Method == http.MethodPost {
+				c.SetSameSite(http.SameSiteStrictMode)
+				c.SetCookie(passwordCookiePrefix+randomID, passwordCookieValue(randomID, meta.PasswordHash),
+					int(time.Until(meta.ExpiresAt).Seconds())+1, "/", "", c.Request.TLS != nil, true)
+			}
+			return true
+		}
+		downloadPasswordAttempts.fail(attemptKey, now)
+		requestLogger(c).Warn("Wrong download password", "id", randomID, "ip", c.ClientIP())
+	}
+	c.Header("Cache-Control", "no-store")
+	if c.Request.Method != http.MethodHead && c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		var page strings.Builder
+		if err := passwordFormTemplate.Execute(&page, struct{ Failed bool }{provided}); err == nil {
+			c.Data(http.StatusUnauthorized, "text/html; charset=utf-8", []byte(page.String()))
+			c.Abort()
+			return false
+		}
+	}
+	c.Header("WWW-Authenticate", `Basic realm="xtemp", charset="UTF-8"`)
+	abortWithError(c, http.StatusUnauthorized, "Password required", nil)
+	return false
+}
+
+// handleDownloadPasswordForm answers POST /:random_id/*filepath from the
+// password form. Once the password is accepted the browser is sent back to the
+// page it asked for, which the unlock cookie now opens.
+func handleDownloadPasswordForm(c *gin.Context) {
+	randomID, _, err := splitEncryptionKey(c.Param("random_id"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid decryption key in URL", err)
+		return
+	}
+	if !checkSignedURL(c, randomID) || !checkDownloadPassword(c, randomID) {
+		return
+	}
+	c.Redirect(http.StatusSeeOther, c.Request.URL.RequestURI())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func basicAuthHeader(password string) map[string]string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("x", password)
+	return map[string]string{"Authorization": req.Header.Get("Authorization")}
+}
+
+func TestDownloadPassword(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", map[string]string{downloadPasswordHeader: "s3cret"})
+
+	tests := []struct {
+		name       string
+		target     string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"no password", upload.path, nil, http.StatusUnauthorized},
+		{"basic auth", upload.path, basicAuthHeader("s3cret"), http.StatusOK},
+		{"header", upload.path, map[string]string{downloadPasswordHeader: "s3cret"}, http.StatusOK},
+		{"query", upload.path + "?password=s3cret", nil, http.StatusOK},
+		{"wrong password", upload.path, basicAuthHeader("guess"), http.StatusUnauthorized},
+		{"info without the password", upload.path + "?info", nil, http.StatusUnauthorized},
+		{"listing without the password", "/" + upload.ID + "/", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(r, http.MethodGet, tt.target, tt.header, ""); w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+	}
+
+	w := serveRequest(r, http.MethodGet, upload.path, nil, "")
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("API client is not challenged for basic auth")
+	}
+	w = serveRequest(r, http.MethodGet, upload.path, map[string]string{"Accept": "text/html"}, "")
+	if !strings.Contains(w.Body.String(), `<form method="post">`) {
+		t.Errorf("browser is not shown the password form: %s", w.Body)
+	}
+}
+
+func TestDownloadPasswordRateLimit(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", map[string]string{downloadPasswordHeader: "s3cret"})
+	download := func(remoteAddr, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, upload.path, nil)
+		req.RemoteAddr = remoteAddr
+		req.SetBasicAuth("x", password)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < passwordAttemptLimit; i++ {
+		if w := download("192.0.2.10:1234", "guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := download("192.0.2.10:1234", "s3cret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("right password after too many wrong ones: status %d, Retry-After %q, want %d", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	if w := download("192.0.2.11:1234", "s3cret"); w.Code != http.StatusOK {
+		t.Errorf("right password from another client: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestPasswordAttemptsWindow(t *testing.T) {
+	attempts := &passwordAttempts{failures: make(map[string][]time.Time)}
+	start := time.Now()
+	for i := 0; i < passwordAttemptLimit; i++ {
+		if wait := attempts.retryAfter("client", start); wait != 0 {
+			t.Fatalf("attempt %d refused for %v", i+1, wait)
+		}
+		attempts.fail("client", start)
+	}
+	if wait := attempts.retryAfter("client", start.Add(time.Minute)); wait != passwordAttemptWindow-time.Minute {
+		t.Errorf("retry after %v, want %v", wait, passwordAttemptWindow-time.Minute)
+	}
+	if wait := attempts.retryAfter("other", start); wait != 0 {
+		t.Errorf("other client refused for %v", wait)
+	}
+	if wait := attempts.retryAfter("client", start.Add(passwordAttemptWindow)); wait != 0 {
+		t.Errorf("refused for %v after the window", wait)
+	}
+	if len(attempts.failures) != 0 {
+		t.Errorf("failures kept after the window: %v", attempts.failures)
+	}
+}
+
+func TestPasswordFormSetsUnlockCookie(t *testing.T) {
+	useMemoryStorage(t)
+	r := newTestRouter(t)
+	upload := putTestFile(t, r, "notes.txt", "hello", map[string]string{downloadPasswordHeader: "s3cret"})
+	other := putTestFile(t, r, "notes.txt", "hello", map[string]string{downloadPasswordHeader: "s3cret"})
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Accept": "text/html"}
+
+	w := serveRequest(r, http.MethodPost, upload.path, form, url.Values{"password": {"guess"}}.Encode())
+	if w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wrong password in the form: status %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	w = serveRequest(r, http.MethodPost, upload.path, form, url.Values{"password": {"s3cret"}}.Encode())
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != upload.path || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("right password in the form: status %d, Location %q, cookies %v", w.Code, w.Header().Get("Location"), cookies)
+	}
+	cookie := cookies[0].Name + "=" + cookies[0].Value
+
+	tests := []struct {
+		name, target, cookie string
+		wantStatus           int
+	}{
+		{"file with the cookie", upload.path, cookie, http.StatusOK},
+		{"listing with the cookie", "/" + upload.ID + "/", cookie, http.StatusOK},
+		{"another upload with the cookie", other.path, passwordCookiePrefix + other.ID + "=" + cookies[0].Value, http.StatusUnauthorized},
+		{"tampered cookie", upload.path, cookie + "0", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(r, http.MethodGet, tt.target, map[string]string{"Cookie": tt.cookie}, ""); w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+	}
+}
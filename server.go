@@ -5,19 +5,46 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 )
 
+// routerSwitch serves requests with the current engine. Settings gin only
+// reads at setup, such as trusted proxies, are changed by building a new engine
+// and swapping it in, so requests in flight never see a half-updated one.
+type routerSwitch struct {
+	engine atomic.Pointer[gin.Engine]
+}
+
+func (s *routerSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.engine.Load().ServeHTTP(w, req)
+}
+
+var router routerSwitch
+
 func main() {
+	setup()
 	gin.SetMode(gin.ReleaseMode)
+	r, err := newRouter(currentConfig())
+	if err != nil {
+		fatal("Failed to set trusted proxies", "error", err)
+	}
+	router.engine.Store(r)
+	logger.Info("Starting XTemp File Service", "addr", ":5000")
+	if err := serve(&http.Server{Addr: ":5000", Handler: &router}); err != nil {
+		fatal("Failed to start server", "error", err)
+	}
+}
+
+// newRouter builds the gin engine for cfg.
+func newRouter(cfg *AppConfig) (*gin.Engine, error) {
 	r := gin.New()
-	r.Use(gin.Logger())
-	r.Use(gin.Recovery())
-	if err := r.SetTrustedProxies(config.TrustedProxies); err != nil {
-		logger.Fatalf("Failed to set trusted proxies: %v", err)
+	r.Use(countInFlight, assignRequestID, logRequests, recoverPanics)
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
 	}
-	logger.Printf("Gin trusted proxies set to: %v", config.TrustedProxies)
+	logger.Debug("Gin trusted proxies set", "trusted_proxies", cfg.TrustedProxies)
 	r.Use(func(c *gin.Context) {
 		c.Header("X-Content-Type-Options", "nosniff")
 		c.Header("X-Frame-Options", "DENY")
@@ -28,34 +55,36 @@ func main() {
 	})
 	r.GET("/", func(c *gin.Context) {
 		filePath := "./static/index.html"
+		log := requestLogger(c)
 		cwd, errCwd := os.Getwd()
 		if errCwd != nil {
-			logger.Printf("GET /: Could not get current working directory: %v", errCwd)
+			log.Warn("Could not get current working directory", "error", errCwd)
 		} else {
-			logger.Printf("GET /: Current working directory: %s", cwd)
+			log.Debug("Current working directory", "cwd", cwd)
 		}
 		absFilePath, errAbs := filepath.Abs(filePath)
 		if errAbs != nil {
-			logger.Printf("GET /: Could not resolve absolute path for %s: %v", filePath, errAbs)
+			log.Warn("Could not resolve absolute path", "path", filePath, "error", errAbs)
 		} else {
-			logger.Printf("GET /: Attempting to serve index.html from absolute path: %s", absFilePath)
+			log.Debug("Attempting to serve index.html", "path", absFilePath)
 		}
 		fileInfo, err := os.Stat(filePath)
 		if os.IsNotExist(err) {
-			logger.Printf("GET /: index.html NOT FOUND at %s (resolved to %s). CWD is %s. Ensure it's copied to the container and path is correct.", filePath, absFilePath, cwd)
+			log.Error("index.html not found, ensure it is copied to the container and the path is correct",
+				"path", filePath, "resolved", absFilePath, "cwd", cwd)
 			c.String(http.StatusNotFound, fmt.Sprintf("Error: index.html not found. Expected at %s relative to CWD (%s).", filePath, cwd))
 			return
 		} else if err != nil {
-			logger.Printf("GET /: Error stating index.html at %s: %v", filePath, err)
+			log.Error("Error stating index.html", "path", filePath, "error", err)
 			c.String(http.StatusInternalServerError, "Internal server error checking for index.html.")
 			return
 		}
 		if fileInfo.IsDir() {
-			logger.Printf("GET /: Path %s is a directory, not a file. Cannot serve index.html.", filePath)
+			log.Error("index.html is a directory, not a file", "path", filePath)
 			c.String(http.StatusNotFound, fmt.Sprintf("Error: Expected index.html to be a file, but found a directory at %s.", filePath))
 			return
 		}
-		logger.Printf("GET /: Serving index.html from %s", filePath)
+		log.Debug("Serving index.html", "path", filePath)
 		c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
 		c.Header("Pragma", "no-cache")
 		c.Header("Expires", "0")
@@ -64,18 +93,29 @@ func main() {
 	r.GET("/config/max_upload_size", handleGetMaxUploadSize)
 	r.GET("/config/server_year", handleGetServerYear)
 	r.GET("/config/retention_policy", handleGetRetentionPolicy)
-	r.GET("/config/set_max_upload_size", handleSetMaxUploadSize)
+	admin := r.Group("/admin", requireAdminToken)
+	admin.GET("/config", handleGetAdminConfig)
+	admin.PATCH("/config", handlePatchAdminConfig)
 	r.GET("/favicon.ico", func(c *gin.Context) {
-		logger.Printf("GET /favicon.ico: Returning 204 No Content.")
 		c.Status(http.StatusNoContent)
 	})
-	r.POST("/", handleUploadPost)
-	r.PUT("/*filepath", handleUploadPut)
-	r.GET("/:random_id/*filepath", handleDownloadFile)
+	r.GET("/metrics", handleMetrics)
+	r.GET("/healthz", handleHealthz)
+	r.GET("/readyz", handleReadyz)
+	r.POST("/", instrumentUploads, requireAPIKey, handleUploadPost)
+	r.POST("/sign/:random_id/*filepath", handleSignURL)
+	tus := r.Group(tusEndpoint, tusMiddleware)
+	tus.OPTIONS("", handleTusOptions)
+	tus.OPTIONS(":upload_id", handleTusOptions)
+	tus.POST("", requireAPIKey, handleTusCreate)
+	tus.HEAD(":upload_id", handleTusHead)
+	tus.PATCH(":upload_id", instrumentChunks, handleTusPatch)
+	tus.DELETE(":upload_id", handleTusDelete)
+	r.PUT("/*filepath", instrumentUploads, requireAPIKey, handleUploadPut)
+	r.GET("/:random_id/*filepath", instrumentDownloads, handleDownloadFile)
+	r.POST("/:random_id/*filepath", handleDownloadPasswordForm)
+	r.HEAD("/:random_id/*filepath", handleHeadFile)
 	r.DELETE("/:random_id/*filepath", handleDeleteFile)
-	r.MaxMultipartMemory = config.MaxUploadSize
-	logger.Println("Starting XTemp File Service on :5000...")
-	if err := r.Run(":5000"); err != nil {
-		logger.Fatalf("Failed to start server: %v", err)
-	}
+	r.MaxMultipartMemory = cfg.MaxUploadSize
+	return r, nil
 }
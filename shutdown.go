@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// abortGracePeriod is how long handlers get, once the drain timeout has passed
+// and their requests are canceled, to remove what they stored partially.
+const abortGracePeriod = 5 * time.Second
+
+// inFlightRequests counts the requests being handled, so a shutdown can tell
+// when the handlers of aborted requests have finished cleaning up.
+var inFlightRequests atomic.Int64
+
+func countInFlight(c *gin.Context) {
+	inFlightRequests.Add(1)
+	defer inFlightRequests.Add(-1)
+	c.Next()
+}
+
+// serve runs server until SIGINT or SIGTERM, then shuts it down: it stops
+// accepting connections and waits up to XTEMP_SHUTDOWN_TIMEOUT_SECONDS for
+// requests in flight. Requests still running after that are canceled and their
+// connections closed, which makes interrupted uploads fail and discard the
+// data they stored so far. A second signal exits at once.
+func serve(server *http.Server) error {
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-signalCtx.Done():
+	}
+	stopSignals()
+
+	timeout := time.Duration(currentConfig().ShutdownTimeoutSeconds) * time.Second
+	logger.Info("Shutting down, draining requests in flight", "timeout", timeout.String(), "in_flight", inFlightRequests.Load())
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), timeout)
+	defer cancelDrain()
+	if err := stopCleanupWorker(drainCtx); err != nil {
+		logger.Warn("Cleanup run did not stop before the drain timeout", "error", err)
+	}
+	err := server.Shutdown(drainCtx)
+	if err == nil {
+		logger.Info("All requests drained, server stopped")
+		return nil
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	logger.Warn("Drain timeout reached, aborting requests in flight", "in_flight", inFlightRequests.Load())
+	cancelRequests()
+	server.Close()
+	deadline := time.Now().Add(abortGracePeriod)
+	for inFlightRequests.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := inFlightRequests.Load(); n > 0 {
+		logger.Error("Exiting with requests still being handled", "in_flight", n)
+	} else {
+		logger.Info("Aborted requests cleaned up, server stopped")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Signed URLs carry ?expires=<unix seconds>&sig=<hex HMAC-SHA256>. The HMAC is
+// keyed by XTEMP_SIGNING_SECRET and covers the random ID, the file path and
+// the expiry. A signature for the bare ID (empty path) opens the listing, the
+// archive and every file under it.
+
+const defaultSignedURLMinutes = 60
+
+func urlSignature(randomID, userFilePath string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(currentConfig().SigningSecret))
+	fmt.Fprintf(mac, "%s/%s\n%d", randomID, userFilePath, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedPath returns the path a download request is signed for: "" for the
+// listing and archives, the sanitized file path otherwise.
+func signedPath(c *gin.Context) string {
+	filePath := c.Param("filepath")
+	if strings.Trim(filePath, "/ ") == "" {
+		return ""
+	}
+	if userFilePath, err := getSanitizedUserPath(filePath); err == nil {
+		return userFilePath
+	}
+	return filePath
+}
+
+// signedQuery returns the signature query of the current request, to carry it
+// over to links under the same ID, or "" if the request is unsigned.
+func signedQuery(c *gin.Context) string {
+	expires, sig := c.Query("expires"), c.Query("sig")
+	if expires == "" || sig == "" {
+		return ""
+	}
+	return "?" + url.Values{"expires": {expires}, "sig": {sig}}.Encode()
+}
+
+// checkSignedURL rejects a download whose signature is present but wrong or
+// expired, and any unsigned download when XTEMP_SIGNED_ONLY is set. It writes
+// the error response itself.
+func checkSignedURL(c *gin.Context, randomID string) bool {
+	expiresStr, sig := c.Query("expires"), c.Query("sig")
+	if expiresStr == "" && sig == "" {
+		if currentConfig().SignedOnly {
+			abortWithError(c, http.StatusForbidden, "This server only serves signed URLs", nil)
+			return false
+		}
+		return true
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if currentConfig().SigningSecret == "" || err != nil {
+		abortWithError(c, http.StatusForbidden, "Invalid URL signature", err)
+		return false
+	}
+	userFilePath := signedPath(c)
+	valid := hmac.Equal([]byte(sig), []byte(urlSignature(randomID, userFilePath, expires)))
+	if !valid && userFilePath != "" {
+		valid = hmac.Equal([]byte(sig), []byte(urlSignature(randomID, "", expires)))
+	}
+	if !valid {
+		abortWithError(c, http.StatusForbidden, "Invalid URL signature", nil)
+		return false
+	}
+	if time.Now().Unix() > expires {
+		abortWithError(c, http.StatusGone, "Signed URL has expired", nil)
+		return false
+	}
+	return true
+}
+
+// handleSignURL answers POST /sign/:random_id/*filepath with a signed link to
+// the file, or to the whole upload when filepath is empty, valid for the given
+// number of minutes. The caller must hold the delete token of the upload.
+func handleSignURL(c *gin.Context) {
+	if currentConfig().SigningSecret == "" {
+		abortWithError(c, http.StatusNotImplemented, fmt.Sprintf("Signed URLs are disabled, set %s to enable them", envSigningSecret), nil)
+		return
+	}
+	segment := c.Param("random_id")
+	randomID, _, err := splitEncryptionKey(segment)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid decryption key in URL", err)
+		return
+	}
+	userFilePath := signedPath(c)
+	if userFilePath != "" {
+		if _, err := getSanitizedUserPath(userFilePath); err != nil {
+			abortWithError(c, http.StatusBadRequest, "Invalid filepath in URL", err)
+			return
+		}
+	}
+	minutes := int64(defaultSignedURLMinutes)
+	if minutesStr := c.DefaultPostForm("minutes", c.Query("minutes")); minutesStr != "" {
+		minutes, err = strconv.ParseInt(minutesStr, 10, 64)
+		if err != nil || minutes <= 0 {
+			abortWithError(c, http.StatusBadRequest, fmt.Sprintf("Invalid minutes value '%s'", minutesStr), err)
+			return
+		}
+	}
+
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "Upload not found", err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	if !meta.checkDeleteToken(getDeleteToken(c)) {
+		abortWithError(c, http.StatusForbidden, "Missing or wrong delete token", nil)
+		return
+	}
+	if userFilePath != "" && meta.file(userFilePath) == nil {
+		abortWithError(c, http.StatusNotFound, "File not found", nil)
+		return
+	}
+
+	// A link never needs to outlive the upload it points to.
+	expiresAt := time.Now().Add(time.Duration(minutes) * time.Minute)
+	if expiresAt.After(meta.ExpiresAt) {
+		expiresAt = meta.ExpiresAt
+	}
+	expires := expiresAt.Unix()
+	signedURL := fmt.Sprintf("%s/%s/%s?%s", getBaseURL(c.Request), segment, url.PathEscape(userFilePath),
+		url.Values{"expires": {strconv.FormatInt(expires, 10)}, "sig": {urlSignature(randomID, userFilePath, expires)}}.Encode())
+	requestLogger(c).Info("Signed URL issued", "id", randomID, "path", userFilePath, "expires_at", expiresAt.UTC(), "ip", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{
+		"url":        signedURL,
+		"expires_at": time.Unix(expires, 0).UTC(),
+	})
+}
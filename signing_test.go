@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testRandomID = "abcdefghijkl"
+
+// checkSignedTestURL runs checkSignedURL on a download of userFilePath
+// carrying query and returns whether it passed and the status it set.
+func checkSignedTestURL(userFilePath string, query url.Values) (bool, int) {
+	req := httptest.NewRequest(http.MethodGet, "/"+testRandomID+"/"+userFilePath+"?"+query.Encode(), nil)
+	c, w := newTestContext(req)
+	c.Params = gin.Params{{Key: "random_id", Value: testRandomID}, {Key: "filepath", Value: "/" + userFilePath}}
+	ok := checkSignedURL(c, testRandomID)
+	return ok, w.Code
+}
+
+func signedTestQuery(userFilePath string, expires int64) url.Values {
+	return url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {urlSignature(testRandomID, userFilePath, expires)},
+	}
+}
+
+func TestURLSignatureCoversIDPathAndExpiry(t *testing.T) {
+	useConfig(t, func(cfg *AppConfig) { cfg.SigningSecret = "secret" })
+	expires := time.Now().Add(time.Hour).Unix()
+	sig := urlSignature(testRandomID, "report.pdf", expires)
+	if again := urlSignature(testRandomID, "report.pdf", expires); again != sig {
+		t.Fatalf("signature is not deterministic: %s != %s", again, sig)
+	}
+	for name, other := range map[string]string{
+		"other id":     urlSignature("mnopqrstuvwx", "report.pdf", expires),
+		"other path":   urlSignature(testRandomID, "other.pdf", expires),
+		"other expiry": urlSignature(testRandomID, "report.pdf", expires+1),
+	} {
+		if other == sig {
+			t.Errorf("%s: signature unchanged", name)
+		}
+	}
+	useConfig(t, func(cfg *AppConfig) { cfg.SigningSecret = "another secret" })
+	if urlSignature(testRandomID, "report.pdf", expires) == sig {
+		t.Error("signature unchanged with another secret")
+	}
+}
+
+func TestCheckSignedURL(t *testing.T) {
+	useConfig(t, func(cfg *AppConfig) { cfg.SigningSecret = "secret" })
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	tamperedSig := signedTestQuery("report.pdf", future)
+	sig := tamperedSig.Get("sig")
+	if sig[0] == '0' {
+		tamperedSig.Set("sig", "1"+sig[1:])
+	} else {
+		tamperedSig.Set("sig", "0"+sig[1:])
+	}
+	extendedExpiry := signedTestQuery("report.pdf", future)
+	extendedExpiry.Set("expires", strconv.FormatInt(future+3600, 10))
+
+	tests := []struct {
+		name       string
+		path       string
+		query      url.Values
+		wantOK     bool
+		wantStatus int
+	}{
+		{"unsigned", "report.pdf", url.Values{}, true, http.StatusOK},
+		{"valid file signature", "report.pdf", signedTestQuery("report.pdf", future), true, http.StatusOK},
+		{"upload signature opens a file", "report.pdf", signedTestQuery("", future), true, http.StatusOK},
+		{"upload signature opens the listing", "", signedTestQuery("", future), true, http.StatusOK},
+		{"file signature for another file", "other.pdf", signedTestQuery("report.pdf", future), false, http.StatusForbidden},
+		{"file signature for the listing", "", signedTestQuery("report.pdf", future), false, http.StatusForbidden},
+		{"tampered signature", "report.pdf", tamperedSig, false, http.StatusForbidden},
+		{"extended expiry", "report.pdf", extendedExpiry, false, http.StatusForbidden},
+		{"malformed expiry", "report.pdf", url.Values{"expires": {"soon"}, "sig": {"00"}}, false, http.StatusForbidden},
+		{"expired", "report.pdf", signedTestQuery("report.pdf", past), false, http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, status := checkSignedTestURL(tt.path, tt.query)
+			if ok != tt.wantOK || status != tt.wantStatus {
+				t.Errorf("checkSignedURL = %v with status %d, want %v with status %d", ok, status, tt.wantOK, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckSignedURLModes(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+	query := signedTestQuery("report.pdf", expires)
+
+	useConfig(t, func(cfg *AppConfig) { cfg.SigningSecret = "" })
+	if ok, status := checkSignedTestURL("report.pdf", query); ok || status != http.StatusForbidden {
+		t.Errorf("signature without a secret configured: %v with status %d, want refused with 403", ok, status)
+	}
+
+	useConfig(t, func(cfg *AppConfig) { cfg.SigningSecret, cfg.SignedOnly = "secret", true })
+	if ok, status := checkSignedTestURL("report.pdf", url.Values{}); ok || status != http.StatusForbidden {
+		t.Errorf("unsigned download in signed-only mode: %v with status %d, want refused with 403", ok, status)
+	}
+	if ok, _ := checkSignedTestURL("report.pdf", signedTestQuery("report.pdf", expires)); !ok {
+		t.Error("signed download refused in signed-only mode")
+	}
+}
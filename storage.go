@@ -1,180 +1,272 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
-	"os"
-	"path/filepath"
+	"net/http"
+	"path"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 )
 
-func buildAndVerifyStoragePath(randomID, userFilePath string) (fullPath string, targetDir string, err error) {
-	targetDir = filepath.Join(config.BaseStoragePath, randomID)
-	fullPath = filepath.Join(targetDir, userFilePath)
-	absBasePath, _ := filepath.Abs(config.BaseStoragePath)
-	absFullPath, _ := filepath.Abs(fullPath)
-	if !strings.HasPrefix(absFullPath, absBasePath) {
-		return "", "", errors.New("invalid filepath, attempts to escape base storage directory")
-	}
-	if config.StorageType == StorageLocal {
-		dirToCreate := filepath.Dir(fullPath)
-		if err := os.MkdirAll(dirToCreate, dirPerm); err != nil {
-			return "", "", fmt.Errorf("failed to create directory %s: %w", dirToCreate, err)
-		}
-	}
-	return fullPath, targetDir, nil
+// internalPrefix holds service bookkeeping such as upload metadata. Random IDs
+// never contain a dot, so it cannot collide with an upload.
+const internalPrefix = ".xtemp/"
+
+// ErrObjectNotFound is returned by Storage implementations when a key does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ErrUploadTooLarge is returned by sizeLimitedReader once more than its limit has been read.
+var ErrUploadTooLarge = errors.New("upload exceeds maximum allowed size")
+
+// ObjectInfo describes a stored object. Keys are slash-separated and relative
+// to the storage root, e.g. "<random_id>/<filepath>".
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
 }
 
-func saveFileContent(dstPath string, src io.Reader) (int64, error) {
-	if config.StorageType == StorageR2 {
-		return saveFileContentR2(dstPath, src)
-	}
-	file, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, filePerm)
-	if err != nil {
-		return 0, fmt.Errorf("failed to open file %s for writing: %w", dstPath, err)
+// Storage is the backend that uploads are written to and served from.
+type Storage interface {
+	// Put writes src to key, replacing any existing object, and returns the number of bytes stored.
+	Put(ctx context.Context, key string, src io.Reader) (int64, error)
+	// Get opens key for reading. The returned reader must be closed by the caller.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// Stat returns information about key without reading its content.
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete removes a single object.
+	Delete(ctx context.Context, key string) error
+	// DeletePrefix removes every object whose key starts with prefix.
+	DeletePrefix(ctx context.Context, prefix string) error
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Expire removes objects last modified before cutoff and reports what it
+	// removed and what is left.
+	Expire(ctx context.Context, cutoff time.Time) (cleanupStats, error)
+	// Ready checks that the backend is reachable and can take new uploads.
+	Ready(ctx context.Context) error
+}
+
+// cleanupStats summarizes one Expire run. Stored counts cover uploaded files
+// only, not internal records.
+type cleanupStats struct {
+	Deleted     int
+	Failed      int
+	StoredFiles int64
+	StoredBytes int64
+}
+
+var store Storage
+
+// chunkedStorage is implemented by backends that can assemble an object from
+// sequential chunks, as used by resumable uploads.
+type chunkedStorage interface {
+	// BeginChunked prepares upload.Key to receive upload.Length bytes.
+	BeginChunked(ctx context.Context, upload *ChunkedUpload) error
+	// AppendChunk writes src at upload.Offset and completes the object once
+	// upload.Length bytes have arrived. upload is updated to reflect every byte
+	// that was persisted, even when an error is returned.
+	AppendChunk(ctx context.Context, upload *ChunkedUpload, src io.Reader) error
+	// AbortChunked discards an unfinished upload.
+	AbortChunked(ctx context.Context, upload *ChunkedUpload) error
+}
+
+// ChunkedUpload is the state of an object being assembled by chunkedStorage.
+// It is kept in the upload record so a transfer can resume after a restart.
+type ChunkedUpload struct {
+	Key    string `json:"key"`
+	Length int64  `json:"length"`
+	Offset int64  `json:"offset"`
+	// HashState is the marshaled SHA-256 state of the bytes received so far.
+	HashState []byte `json:"hash_state,omitempty"`
+	// MultipartID, Parts and Buffered track an R2 multipart upload. Buffered
+	// bytes are too few for a part and wait in a staging object.
+	MultipartID string        `json:"multipart_id,omitempty"`
+	Parts       []ChunkedPart `json:"parts,omitempty"`
+	Buffered    int64         `json:"buffered,omitempty"`
+}
+
+// ChunkedPart is one uploaded part of an R2 multipart upload.
+type ChunkedPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+func (u *ChunkedUpload) complete() bool {
+	return u.Offset >= u.Length
+}
+
+// conditionalGetter is implemented by backends that evaluate HTTP Range and
+// conditional request headers themselves. Backends without it must return an
+// io.ReadSeeker from Get so http.ServeContent can do the same work.
+type conditionalGetter interface {
+	GetConditional(ctx context.Context, key string, reqHeader http.Header) (*conditionalObject, error)
+}
+
+// conditionalObject is the outcome of a conditional get: the status to send,
+// the response headers describing the content, and a body unless the status
+// is 304, 412 or 416.
+type conditionalObject struct {
+	Status int
+	Header http.Header
+	Body   io.ReadCloser
+}
+
+// sizeLimitedReader fails with ErrUploadTooLarge as soon as more than limit
+// bytes have been read, so backends stop writing without buffering the rest.
+type sizeLimitedReader struct {
+	r        io.Reader
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+func newSizeLimitedReader(r io.Reader, limit int64) *sizeLimitedReader {
+	return &sizeLimitedReader{r: r, limit: limit}
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrUploadTooLarge
 	}
-	defer file.Close()
-	buf := make([]byte, bufferSize)
-	written, err := io.CopyBuffer(file, src, buf)
-	if err != nil {
-		os.Remove(dstPath)
-		return 0, fmt.Errorf("failed to write content to file %s: %w", dstPath, err)
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		l.exceeded = true
+		return n, ErrUploadTooLarge
 	}
-	return written, nil
+	return n, err
 }
 
-func saveFileContentR2(dstPath string, src io.Reader) (int64, error) {
-	rel, err := filepath.Rel(config.BaseStoragePath, dstPath)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get relative path for R2 key: %w", err)
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newStorage(cfg *AppConfig) (Storage, error) {
+	switch cfg.StorageType {
+	case StorageR2:
+		return newR2Storage(cfg)
+	default:
+		return newLocalStorage(cfg.BaseStoragePath, cfg.Dedup, cfg.MinFreeSpace)
 	}
-	key := filepath.ToSlash(rel)
-	buf := new(bytes.Buffer)
-	n, err := io.Copy(buf, src)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read file content for R2 upload: %w", err)
+}
+
+// buildAndVerifyStoragePath returns the storage key for userFilePath under randomID,
+// rejecting paths that would escape the random ID prefix.
+func buildAndVerifyStoragePath(randomID, userFilePath string) (string, error) {
+	if randomID == "" || strings.ContainsAny(randomID, `/\.`) {
+		return "", errors.New("invalid random id")
 	}
-	upParams := &s3.PutObjectInput{
-		Bucket: aws.String(r2Bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(buf.Bytes()),
+	key := path.Join(randomID, userFilePath)
+	if key != randomID && !strings.HasPrefix(key, randomID+"/") {
+		return "", errors.New("invalid filepath, attempts to escape base storage directory")
 	}
-	_, err = s3Client.PutObject(upParams)
-	if err != nil {
-		return 0, fmt.Errorf("failed to upload to R2: %w", err)
+	return key, nil
+}
+
+// cleanupRescheduled wakes the cleanup worker to pick up a new interval.
+var cleanupRescheduled = make(chan struct{}, 1)
+
+// rescheduleCleanup makes the cleanup worker restart its wait with the
+// interval now in effect.
+func rescheduleCleanup() {
+	select {
+	case cleanupRescheduled <- struct{}{}:
+	default:
 	}
-	return n, nil
+}
+
+// cleanupWorker is the running cleanup goroutine; cancel is nil while the
+// worker is disabled.
+var cleanupWorker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 func startCleanupWorker() {
-	if config.RetentionSeconds <= 0 {
-		logger.Printf("Cleanup worker disabled because retention is %d second(s)", config.RetentionSeconds)
+	cfg := currentConfig()
+	if cfg.RetentionSeconds <= 0 {
+		logger.Warn("Cleanup worker disabled because retention is not positive", "retention_seconds", cfg.RetentionSeconds)
 		return
 	}
-	if config.CleanupIntervalSeconds <= 0 {
-		logger.Printf("Cleanup worker disabled because interval is %d second(s)", config.CleanupIntervalSeconds)
+	if cfg.CleanupIntervalSeconds <= 0 {
+		logger.Warn("Cleanup worker disabled because interval is not positive", "cleanup_interval_seconds", cfg.CleanupIntervalSeconds)
 		return
 	}
 
-	runCleanupOnce()
+	ctx, cancel := context.WithCancel(context.Background())
+	cleanupWorker.cancel, cleanupWorker.done = cancel, make(chan struct{})
+	runCleanupOnce(ctx)
 
-	ticker := time.NewTicker(time.Duration(config.CleanupIntervalSeconds) * time.Second)
 	go func() {
-		defer ticker.Stop()
-		for range ticker.C {
-			runCleanupOnce()
+		defer close(cleanupWorker.done)
+		for {
+			timer := time.NewTimer(time.Duration(currentConfig().CleanupIntervalSeconds) * time.Second)
+			select {
+			case <-timer.C:
+				runCleanupOnce(ctx)
+			case <-cleanupRescheduled:
+				timer.Stop()
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
 		}
 	}()
 
-	logger.Printf("Cleanup worker started. Interval: %ds, retention: %ds, storage: %s", config.CleanupIntervalSeconds, config.RetentionSeconds, config.StorageType)
-}
-
-func runCleanupOnce() {
-	if config.StorageType == StorageR2 {
-		runR2CleanupOnce()
-		return
-	}
-	runLocalCleanupOnce()
+	logger.Info("Cleanup worker started",
+		"interval_seconds", cfg.CleanupIntervalSeconds,
+		"retention_seconds", cfg.RetentionSeconds,
+		"storage", cfg.StorageType)
 }
 
-func runLocalCleanupOnce() {
-	entries, err := os.ReadDir(config.BaseStoragePath)
-	if err != nil {
-		logger.Printf("Local cleanup skipped: failed to list storage path %s: %v", config.BaseStoragePath, err)
-		return
+// stopCleanupWorker cancels the cleanup worker and waits, until ctx is done,
+// for a run in progress to end.
+func stopCleanupWorker(ctx context.Context) error {
+	if cleanupWorker.cancel == nil {
+		return nil
 	}
-
-	cutoff := time.Now().Add(-time.Duration(config.RetentionSeconds) * time.Second)
-	for _, entry := range entries {
-		targetPath := filepath.Join(config.BaseStoragePath, entry.Name())
-		newest, statErr := newestModTime(targetPath)
-		if statErr != nil {
-			logger.Printf("Local cleanup: failed to inspect %s: %v", targetPath, statErr)
-			continue
-		}
-		if newest.After(cutoff) {
-			continue
-		}
-		if rmErr := os.RemoveAll(targetPath); rmErr != nil {
-			logger.Printf("Local cleanup: failed to remove expired path %s: %v", targetPath, rmErr)
-			continue
-		}
-		logger.Printf("Local cleanup: removed expired path %s", targetPath)
+	cleanupWorker.cancel()
+	select {
+	case <-cleanupWorker.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func runR2CleanupOnce() {
-	if s3Client == nil || r2Bucket == "" {
-		logger.Printf("R2 cleanup skipped: client or bucket not initialized")
-		return
+func runCleanupOnce(ctx context.Context) {
+	cfg := currentConfig()
+	start := time.Now()
+	var expired cleanupStats
+	metaErr := expireUploads(ctx, &expired)
+	if metaErr != nil && ctx.Err() == nil {
+		logger.Error("Metadata cleanup failed", "storage", cfg.StorageType, "error", metaErr)
+		expired.Failed++
 	}
-
-	cutoff := time.Now().Add(-time.Duration(config.RetentionSeconds) * time.Second)
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(r2Bucket),
+	cutoff := start.Add(-time.Duration(cfg.RetentionSeconds) * time.Second)
+	stats, err := store.Expire(ctx, cutoff)
+	if ctx.Err() != nil {
+		// Stopped by shutdown; the next run picks up where this one ended.
+		logger.Info("Cleanup interrupted", "storage", cfg.StorageType)
+		return
 	}
-
-	err := s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-		for _, obj := range page.Contents {
-			if obj == nil || obj.Key == nil || obj.LastModified == nil {
-				continue
-			}
-			if obj.LastModified.After(cutoff) {
-				continue
-			}
-			_, delErr := s3Client.DeleteObject(&s3.DeleteObjectInput{
-				Bucket: aws.String(r2Bucket),
-				Key:    obj.Key,
-			})
-			if delErr != nil {
-				logger.Printf("R2 cleanup: failed to delete object %s: %v", *obj.Key, delErr)
-				continue
-			}
-			logger.Printf("R2 cleanup: deleted expired object %s", *obj.Key)
-		}
-		return !lastPage
-	})
 	if err != nil {
-		logger.Printf("R2 cleanup failed: %v", err)
+		logger.Error("Cleanup failed", "storage", cfg.StorageType, "error", err)
+		stats.Failed++
 	}
-}
-
-func newestModTime(root string) (time.Time, error) {
-	var newest time.Time
-	err := filepath.Walk(root, func(_ string, info os.FileInfo, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if info.ModTime().After(newest) {
-			newest = info.ModTime()
-		}
-		return nil
-	})
-	return newest, err
+	stats.Deleted += expired.Deleted
+	stats.Failed += expired.Failed
+	recordCleanup(cfg.StorageType, stats, time.Since(start))
+	recordCleanupResult(start, errors.Join(metaErr, err))
 }
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blobPrefix holds the content-addressed blobs of a deduplicating localStorage.
+const blobPrefix = internalPrefix + "blobs/"
+
+// incomingBlobPattern names blobs still being written, before their hash is known.
+const incomingBlobPattern = "incoming-*"
+
+// incomingPrefix holds files still being written by Put. They are renamed into
+// place once complete, so a reader never sees a partial file. It is on the
+// same filesystem as the uploads, which keeps the rename atomic.
+const incomingPrefix = internalPrefix + "incoming/"
+
+// chunkedPrefix holds the data of resumable uploads until their last chunk
+// arrives. Unlike other incoming files, these may go unwritten for the whole
+// retention window while the client is away, so they expire with it.
+const chunkedPrefix = incomingPrefix + "chunked/"
+
+// incomingGracePeriod is how long an incoming file may go unwritten before
+// cleanup treats it as left behind by a crash.
+const incomingGracePeriod = time.Hour
+
+// blobGracePeriod protects a blob that has just been written from cleanup
+// until the upload linking to it has been created.
+const blobGracePeriod = time.Minute
+
+type localStorage struct {
+	basePath string
+	// dedup stores each distinct content once under blobPrefix, keyed by its
+	// SHA-256, and makes upload paths hard links to it. The link count of a blob
+	// is its reference count, so it survives restarts without bookkeeping.
+	dedup bool
+	// minFreeSpace is the free space, in bytes, below which Ready fails.
+	minFreeSpace int64
+}
+
+func newLocalStorage(basePath string, dedup bool, minFreeSpace int64) (*localStorage, error) {
+	if err := os.MkdirAll(basePath, dirPerm); err != nil {
+		return nil, fmt.Errorf("could not create base storage directory %s: %w", basePath, err)
+	}
+	logger.Info("Base storage directory ensured", "path", basePath, "mode", fmt.Sprintf("%#o", dirPerm))
+	if dedup && !hardLinksCounted {
+		logger.Warn("Deduplication is not supported on this platform and stays disabled")
+		dedup = false
+	}
+	return &localStorage{basePath: basePath, dedup: dedup, minFreeSpace: minFreeSpace}, nil
+}
+
+// path maps a storage key to a filesystem path, refusing keys that resolve outside basePath.
+func (s *localStorage) path(key string) (string, error) {
+	fullPath := filepath.Join(s.basePath, filepath.FromSlash(key))
+	absBasePath, _ := filepath.Abs(s.basePath)
+	absFullPath, _ := filepath.Abs(fullPath)
+	if absFullPath == absBasePath || !strings.HasPrefix(absFullPath, absBasePath+string(filepath.Separator)) {
+		return "", errors.New("invalid filepath, attempts to escape base storage directory")
+	}
+	return fullPath, nil
+}
+
+func (s *localStorage) Put(_ context.Context, key string, src io.Reader) (int64, error) {
+	dstPath, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if s.dedup && !strings.HasPrefix(key, internalPrefix) {
+		return s.putBlob(dstPath, src)
+	}
+	incomingDir := filepath.Join(s.basePath, filepath.FromSlash(incomingPrefix))
+	if err := os.MkdirAll(incomingDir, dirPerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %w", incomingDir, err)
+	}
+	tmp, err := os.CreateTemp(incomingDir, "put-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %s for writing: %w", dstPath, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(filePerm); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to set permissions of %s: %w", dstPath, err)
+	}
+	written, err := writeSynced(tmp, src)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write content to file %s: %w", dstPath, err)
+	}
+	// Renaming replaces an old file, even one hard linked to a shared blob,
+	// without touching its content.
+	if err := placeFile(dstPath, func() error { return os.Rename(tmp.Name(), dstPath) }); err != nil {
+		return 0, fmt.Errorf("failed to move file into place at %s: %w", dstPath, err)
+	}
+	return written, nil
+}
+
+// placeFile creates the directory of dstPath and runs place to put the file
+// there. The directory is only created once the content is complete, since
+// cleanup may expire an empty upload directory at any time; for the same
+// reason place is retried once if the directory vanished in between.
+func placeFile(dstPath string, place func() error) error {
+	dir := filepath.Dir(dstPath)
+	for attempt := 0; ; attempt++ {
+		if err := os.MkdirAll(dir, dirPerm); err != nil {
+			return err
+		}
+		err := place()
+		if err == nil {
+			syncDir(dir)
+			return nil
+		}
+		if attempt > 0 || !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+// writeSynced copies src to file, flushes it to disk and closes it.
+func writeSynced(file *os.File, src io.Reader) (int64, error) {
+	buf := make([]byte, bufferSize)
+	written, err := io.CopyBuffer(file, src, buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// syncDir flushes the directory entries of dir, so a rename into it survives a
+// crash. It is best effort: not every platform can sync a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// putBlob writes src to a temporary blob while hashing it, then links dstPath
+// to the blob for that hash, reusing an existing blob with the same content.
+func (s *localStorage) putBlob(dstPath string, src io.Reader) (int64, error) {
+	blobDir := filepath.Join(s.basePath, filepath.FromSlash(blobPrefix))
+	if err := os.MkdirAll(blobDir, dirPerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %w", blobDir, err)
+	}
+	tmp, err := os.CreateTemp(blobDir, incomingBlobPattern)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create blob in %s: %w", blobDir, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(filePerm); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to set permissions of %s: %w", dstPath, err)
+	}
+	hasher := sha256.New()
+	written, err := writeSynced(tmp, io.TeeReader(src, hasher))
+	if err != nil {
+		return 0, fmt.Errorf("failed to write content to file %s: %w", dstPath, err)
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	blobPath := filepath.Join(blobDir, sum[:2], sum)
+	if err := os.MkdirAll(filepath.Dir(blobPath), dirPerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %w", filepath.Dir(blobPath), err)
+	}
+	err = placeFile(dstPath, func() error {
+		// The old file may be a hard link to a shared blob, so it is unlinked
+		// rather than truncated. This happens only once the new content is
+		// complete, so the path never shows a partial file.
+		if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Reuse an existing blob with the same content if there is one.
+		if err := os.Link(blobPath, dstPath); !os.IsNotExist(err) {
+			return err
+		}
+		// The link also fails when the upload directory is gone; only store
+		// the new blob if it is the blob that is missing.
+		if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+			if err := os.Rename(tmp.Name(), blobPath); err != nil {
+				return err
+			}
+		}
+		return os.Link(blobPath, dstPath)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to link %s to a blob: %w", dstPath, err)
+	}
+	return written, nil
+}
+
+func (s *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	fullPath, _ := s.path(key)
+	file, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file %s: %w", fullPath, err)
+	}
+	return file, info, nil
+}
+
+func (s *localStorage) Stat(_ context.Context, key string) (*ObjectInfo, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", fullPath, err)
+	}
+	if fi.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Delete(_ context.Context, key string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fullPath); os.IsNotExist(err) {
+		return ErrObjectNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", fullPath, err)
+	}
+	return nil
+}
+
+// DeletePrefix removes the directory named by prefix. Prefixes are expected to
+// end on a path segment boundary, e.g. "<random_id>/".
+func (s *localStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fullPath, err := s.path(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		return ErrObjectNotFound
+	}
+	if err := os.RemoveAll(fullPath); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", fullPath, err)
+	}
+	return nil
+}
+
+func (s *localStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	root := s.basePath
+	if dir := strings.TrimSuffix(prefix, "/"); dir != "" {
+		var err error
+		if root, err = s.path(dir); err != nil {
+			return nil, err
+		}
+	}
+	var objects []ObjectInfo
+	err := filepath.Walk(root, func(p string, info os.FileInfo, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			if os.IsNotExist(walkErr) && p == root {
+				return nil
+			}
+			return walkErr
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.basePath, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", root, err)
+	}
+	return objects, nil
+}
+
+// chunkedPath is where the data of upload is kept until it is complete.
+func (s *localStorage) chunkedPath(upload *ChunkedUpload) string {
+	sum := sha256.Sum256([]byte(upload.Key))
+	return filepath.Join(s.basePath, filepath.FromSlash(chunkedPrefix), hex.EncodeToString(sum[:]))
+}
+
+func (s *localStorage) BeginChunked(ctx context.Context, upload *ChunkedUpload) error {
+	if upload.Length == 0 {
+		_, err := s.Put(ctx, upload.Key, strings.NewReader(""))
+		return err
+	}
+	chunkedPath := s.chunkedPath(upload)
+	dirToCreate := filepath.Dir(chunkedPath)
+	if err := os.MkdirAll(dirToCreate, dirPerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dirToCreate, err)
+	}
+	file, err := os.OpenFile(chunkedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", chunkedPath, err)
+	}
+	return file.Close()
+}
+
+// AppendChunk writes src to the incoming file of upload and, once the last
+// byte has arrived, moves it to upload.Key, so the file is never seen partial.
+func (s *localStorage) AppendChunk(_ context.Context, upload *ChunkedUpload, src io.Reader) error {
+	dstPath, err := s.path(upload.Key)
+	if err != nil {
+		return err
+	}
+	chunkedPath := s.chunkedPath(upload)
+	file, err := os.OpenFile(chunkedPath, os.O_WRONLY, filePerm)
+	if os.IsNotExist(err) {
+		return ErrObjectNotFound
+	} else if err != nil {
+		return fmt.Errorf("failed to open file %s for appending: %w", chunkedPath, err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", chunkedPath, err)
+	}
+	if fi.Size() < upload.Offset {
+		return fmt.Errorf("file %s holds %d bytes but upload is at offset %d", chunkedPath, fi.Size(), upload.Offset)
+	}
+	// Bytes past the recorded offset were written by a chunk whose progress was
+	// never saved, so they are dropped and must be sent again.
+	if err := file.Truncate(upload.Offset); err != nil {
+		return fmt.Errorf("failed to truncate %s to offset %d: %w", chunkedPath, upload.Offset, err)
+	}
+	if _, err := file.Seek(upload.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s to offset %d: %w", chunkedPath, upload.Offset, err)
+	}
+	buf := make([]byte, bufferSize)
+	written, copyErr := io.CopyBuffer(file, src, buf)
+	if syncErr := file.Sync(); copyErr == nil && syncErr != nil {
+		copyErr = syncErr
+	}
+	if copyErr != nil {
+		upload.Offset += written
+		return fmt.Errorf("failed to append to file %s: %w", chunkedPath, copyErr)
+	}
+	if upload.Offset+written >= upload.Length {
+		// The offset only reaches the end once the file is in place, so a
+		// failed move has the client send the last chunk again.
+		if err := placeFile(dstPath, func() error { return os.Rename(chunkedPath, dstPath) }); err != nil {
+			return fmt.Errorf("failed to move file into place at %s: %w", dstPath, err)
+		}
+	}
+	upload.Offset += written
+	return nil
+}
+
+func (s *localStorage) AbortChunked(ctx context.Context, upload *ChunkedUpload) error {
+	if err := os.Remove(s.chunkedPath(upload)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", s.chunkedPath(upload), err)
+	}
+	if err := s.Delete(ctx, upload.Key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Ready writes and removes a probe file under the internal prefix, and checks
+// free space where the platform reports it. A probe left behind by a crash
+// expires like any internal record.
+func (s *localStorage) Ready(_ context.Context) error {
+	dir := filepath.Join(s.basePath, filepath.FromSlash(internalPrefix))
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return fmt.Errorf("storage path %s is not writable: %w", s.basePath, err)
+	}
+	probe, err := os.CreateTemp(dir, "probe-*")
+	if err != nil {
+		return fmt.Errorf("storage path %s is not writable: %w", s.basePath, err)
+	}
+	_, writeErr := probe.Write([]byte("ok"))
+	closeErr := probe.Close()
+	removeErr := os.Remove(probe.Name())
+	if err := errors.Join(writeErr, closeErr, removeErr); err != nil {
+		return fmt.Errorf("storage path %s is not writable: %w", s.basePath, err)
+	}
+	if free, ok := freeDiskSpace(s.basePath); ok && free < uint64(s.minFreeSpace) {
+		return fmt.Errorf("storage path %s has %d bytes free, below the %d byte minimum", s.basePath, free, s.minFreeSpace)
+	}
+	return nil
+}
+
+// Expire removes whole random ID directories whose newest entry is older than cutoff,
+// so files uploaded together also expire together.
+func (s *localStorage) Expire(ctx context.Context, cutoff time.Time) (cleanupStats, error) {
+	var stats cleanupStats
+	entries, err := os.ReadDir(s.basePath)
+	if err != nil {
+		return stats, fmt.Errorf("failed to list storage path %s: %w", s.basePath, err)
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		targetPath := filepath.Join(s.basePath, entry.Name())
+		if entry.Name()+"/" == internalPrefix {
+			s.expireFiles(ctx, targetPath, cutoff, &stats)
+			continue
+		}
+		usage, statErr := inspectTree(ctx, targetPath)
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		if statErr != nil {
+			logger.Error("Local cleanup: failed to inspect path", "path", targetPath, "error", statErr)
+			stats.Failed++
+			continue
+		}
+		if usage.newest.After(cutoff) {
+			stats.StoredFiles += usage.files
+			stats.StoredBytes += usage.bytes
+			continue
+		}
+		if rmErr := os.RemoveAll(targetPath); rmErr != nil {
+			logger.Error("Local cleanup: failed to remove expired path", "path", targetPath, "error", rmErr)
+			stats.Failed++
+			continue
+		}
+		stats.Deleted += int(usage.files)
+		logger.Info("Local cleanup: removed expired path", "path", targetPath)
+	}
+	return stats, nil
+}
+
+// expireFiles removes individual files under root older than cutoff. It is used for
+// internal records, which unlike uploads do not expire as a directory. Blobs
+// are left to expireBlobs. Incoming files left behind by a crash go once they
+// have not been written for incomingGracePeriod, or at cutoff if that is sooner.
+// Resumable uploads waiting for their next chunk are kept until cutoff.
+func (s *localStorage) expireFiles(ctx context.Context, root string, cutoff time.Time, stats *cleanupStats) {
+	blobDir := filepath.Join(s.basePath, filepath.FromSlash(blobPrefix))
+	incomingDir := filepath.Join(s.basePath, filepath.FromSlash(incomingPrefix))
+	chunkedDir := filepath.Join(s.basePath, filepath.FromSlash(chunkedPrefix))
+	err := filepath.Walk(root, func(p string, info os.FileInfo, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.IsDir() && p == blobDir {
+			s.expireBlobs(ctx, blobDir, cutoff, stats)
+			return filepath.SkipDir
+		}
+		if info.IsDir() && p == incomingDir && root != incomingDir {
+			incomingCutoff := time.Now().Add(-incomingGracePeriod)
+			if cutoff.After(incomingCutoff) {
+				incomingCutoff = cutoff
+			}
+			s.expireFiles(ctx, incomingDir, incomingCutoff, stats)
+			if _, err := os.Stat(chunkedDir); err == nil {
+				s.expireFiles(ctx, chunkedDir, cutoff, stats)
+			}
+			return filepath.SkipDir
+		}
+		if info.IsDir() && p == chunkedDir && root != chunkedDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if rmErr := os.Remove(p); rmErr != nil {
+			logger.Error("Local cleanup: failed to remove expired record", "path", p, "error", rmErr)
+			stats.Failed++
+			return nil
+		}
+		stats.Deleted++
+		logger.Debug("Local cleanup: removed expired record", "path", p)
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Error("Local cleanup: failed to inspect path", "path", root, "error", err)
+		stats.Failed++
+	}
+}
+
+// expireBlobs removes blobs that no upload links to any more. Blobs are kept
+// while any reference remains, however old they are. Incoming blobs left
+// behind by an interrupted upload expire like records, at cutoff.
+func (s *localStorage) expireBlobs(ctx context.Context, blobDir string, cutoff time.Time, stats *cleanupStats) {
+	graceCutoff := time.Now().Add(-blobGracePeriod)
+	err := filepath.Walk(blobDir, func(p string, info os.FileInfo, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.IsDir() || info.ModTime().After(graceCutoff) {
+			return nil
+		}
+		if matched, _ := filepath.Match(incomingBlobPattern, info.Name()); matched {
+			if info.ModTime().Before(cutoff) && os.Remove(p) == nil {
+				stats.Deleted++
+			}
+			return nil
+		}
+		if links, ok := hardLinkCount(info); !ok || links > 1 {
+			return nil
+		}
+		if rmErr := os.Remove(p); rmErr != nil {
+			logger.Error("Local cleanup: failed to remove unreferenced blob", "path", p, "error", rmErr)
+			stats.Failed++
+			return nil
+		}
+		stats.Deleted++
+		logger.Debug("Local cleanup: removed unreferenced blob", "path", p)
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Error("Local cleanup: failed to inspect path", "path", blobDir, "error", err)
+		stats.Failed++
+	}
+}
+
+// treeUsage describes the regular files below a directory.
+type treeUsage struct {
+	newest time.Time
+	files  int64
+	bytes  int64
+}
+
+func inspectTree(ctx context.Context, root string) (treeUsage, error) {
+	var usage treeUsage
+	err := filepath.Walk(root, func(_ string, info os.FileInfo, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if info.ModTime().After(usage.newest) {
+			usage.newest = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			usage.files++
+			usage.bytes += info.Size()
+		}
+		return nil
+	})
+	return usage, err
+}
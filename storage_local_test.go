@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStorage(t *testing.T) *localStorage {
+	t.Helper()
+	s, err := newLocalStorage(t.TempDir(), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// incomingFiles lists the files under incomingPrefix, by path relative to it.
+func incomingFiles(t *testing.T, s *localStorage) []string {
+	t.Helper()
+	root := filepath.Join(s.basePath, filepath.FromSlash(incomingPrefix))
+	var files []string
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(root, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+func TestLocalPutLeavesNoIncomingFiles(t *testing.T) {
+	s := newTestLocalStorage(t)
+	ctx := context.Background()
+	if _, err := s.Put(ctx, "abcdefghijkl/notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, "abcdefghijkl/notes.txt", errReader{}); err == nil {
+		t.Fatal("Put with a failing reader succeeded")
+	}
+	if files := incomingFiles(t, s); len(files) != 0 {
+		t.Errorf("incoming files left behind: %v", files)
+	}
+	content, _, err := s.Get(ctx, "abcdefghijkl/notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if buf, _ := io.ReadAll(content); string(buf) != "hello" {
+		t.Errorf("failed Put replaced the file: content %q", buf)
+	}
+}
+
+func TestLocalChunkedUploadIsStagedUntilComplete(t *testing.T) {
+	s := newTestLocalStorage(t)
+	ctx := context.Background()
+	upload := &ChunkedUpload{Key: "abcdefghijkl/notes.txt", Length: 10}
+	if err := s.BeginChunked(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendChunk(ctx, upload, strings.NewReader("01234")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, upload.Key); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("partial upload is visible at its key: error %v", err)
+	}
+	if err := s.AppendChunk(ctx, upload, strings.NewReader("56789")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Stat(ctx, upload.Key); err != nil || info.Size != 10 || upload.Offset != 10 {
+		t.Errorf("completed upload: info %v, error %v, offset %d", info, err, upload.Offset)
+	}
+	if files := incomingFiles(t, s); len(files) != 0 {
+		t.Errorf("incoming files left behind: %v", files)
+	}
+}
+
+func TestLocalExpireIncomingFiles(t *testing.T) {
+	s := newTestLocalStorage(t)
+	ctx := context.Background()
+	incomingDir := filepath.Join(s.basePath, filepath.FromSlash(incomingPrefix))
+	if err := os.MkdirAll(incomingDir, dirPerm); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * incomingGracePeriod)
+	for name, modTime := range map[string]time.Time{"put-stale": stale, "put-fresh": time.Now()} {
+		path := filepath.Join(incomingDir, name)
+		if err := os.WriteFile(path, []byte("x"), filePerm); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	// A resumable upload waiting as long as a crashed Put is still resumable.
+	upload := &ChunkedUpload{Key: "abcdefghijkl/notes.txt", Length: 10}
+	if err := s.BeginChunked(ctx, upload); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(s.chunkedPath(upload), stale, stale)
+
+	if _, err := s.Expire(ctx, time.Now().Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(incomingFiles(t, s), ",")
+	if want := "chunked/" + filepath.Base(s.chunkedPath(upload)) + ",put-fresh"; got != want {
+		t.Errorf("incoming files after cleanup: %s, want %s", got, want)
+	}
+
+	if _, err := s.Expire(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if files := incomingFiles(t, s); len(files) != 0 {
+		t.Errorf("incoming files left after the retention window: %v", files)
+	}
+	if err := s.AppendChunk(ctx, upload, strings.NewReader("01234")); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("append to an expired upload: error %v, want %v", err, ErrObjectNotFound)
+	}
+}
+
+// errReader fails every read.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestLocalStorageStopsWhenCanceled(t *testing.T) {
+	s := newTestLocalStorage(t)
+	if _, err := s.Put(context.Background(), "abcdefghijkl/notes.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.Expire(ctx, time.Now().Add(time.Hour)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expire: error %v, want %v", err, context.Canceled)
+	}
+	if _, err := s.List(ctx, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("List: error %v, want %v", err, context.Canceled)
+	}
+	if err := s.DeletePrefix(ctx, "abcdefghijkl/"); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeletePrefix: error %v, want %v", err, context.Canceled)
+	}
+	if _, err := s.Stat(context.Background(), "abcdefghijkl/notes.txt"); err != nil {
+		t.Errorf("canceled calls removed the file: %v", err)
+	}
+}
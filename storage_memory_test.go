@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStorage is a Storage kept in a map, so tests run without touching
+// disk or the network. It supports resumable uploads like localStorage.
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memoryFile is what Get returns; it can be seeked like a local file.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string]memoryObject)}
+}
+
+// useMemoryStorage installs an empty memoryStorage as the store for the
+// duration of the test. Usage tracked for API keys is reset with it.
+func useMemoryStorage(t *testing.T) *memoryStorage {
+	t.Helper()
+	previous := store
+	s := newMemoryStorage()
+	store = s
+	resetKeyUsage := func() {
+		keyUsage.mu.Lock()
+		keyUsage.uploads, keyUsage.loaded, keyUsage.reserved = nil, false, nil
+		keyUsage.mu.Unlock()
+	}
+	resetKeyUsage()
+	t.Cleanup(func() {
+		store = previous
+		resetKeyUsage()
+	})
+	return s
+}
+
+func (s *memoryStorage) Put(_ context.Context, key string, src io.Reader) (int64, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (s *memoryStorage) Get(_ context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, nil, ErrObjectNotFound
+	}
+	return memoryFile{bytes.NewReader(obj.data)}, obj.info(key), nil
+}
+
+func (s *memoryStorage) Stat(_ context.Context, key string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return obj.info(key), nil
+}
+
+func (s *memoryStorage) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[key]; !ok {
+		return ErrObjectNotFound
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStorage) DeletePrefix(_ context.Context, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := false
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.objects, key)
+			found = true
+		}
+	}
+	if !found {
+		return ErrObjectNotFound
+	}
+	return nil
+}
+
+func (s *memoryStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, *obj.info(key))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *memoryStorage) Expire(_ context.Context, cutoff time.Time) (cleanupStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stats cleanupStats
+	for key, obj := range s.objects {
+		if obj.modTime.Before(cutoff) {
+			delete(s.objects, key)
+			stats.Deleted++
+		} else if !strings.HasPrefix(key, internalPrefix) {
+			stats.StoredFiles++
+			stats.StoredBytes += int64(len(obj.data))
+		}
+	}
+	return stats, nil
+}
+
+func (s *memoryStorage) Ready(context.Context) error {
+	return nil
+}
+
+func (s *memoryStorage) BeginChunked(ctx context.Context, upload *ChunkedUpload) error {
+	_, err := s.Put(ctx, upload.Key, strings.NewReader(""))
+	return err
+}
+
+func (s *memoryStorage) AppendChunk(_ context.Context, upload *ChunkedUpload, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[upload.Key]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	obj.data = append(obj.data[:upload.Offset], data...)
+	obj.modTime = time.Now()
+	s.objects[upload.Key] = obj
+	upload.Offset += int64(len(data))
+	return err
+}
+
+func (s *memoryStorage) AbortChunked(ctx context.Context, upload *ChunkedUpload) error {
+	s.Delete(ctx, upload.Key)
+	return nil
+}
+
+func (obj memoryObject) info(key string) *ObjectInfo {
+	return &ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}
+}
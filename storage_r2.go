@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	r2UploadPartSize    int64 = 8 << 20
+	r2UploadConcurrency       = 2
+)
+
+type r2Storage struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newR2Storage(cfg *AppConfig) (*r2Storage, error) {
+	endpoint := fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.R2AccountID)
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("auto"),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials(cfg.R2AccessKeyID, cfg.R2SecretAccessKey, ""),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create R2 session: %w", err)
+	}
+	client := s3.New(sess)
+	// Parts are buffered in memory, so each upload holds at most
+	// PartSize*Concurrency bytes regardless of the file size.
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		u.PartSize = r2UploadPartSize
+		if minPartSize := cfg.MaxUploadSize/s3manager.MaxUploadParts + 1; minPartSize > u.PartSize {
+			u.PartSize = minPartSize
+		}
+		u.Concurrency = r2UploadConcurrency
+		u.LeavePartsOnError = false
+	})
+	logger.Info("R2 client initialized", "endpoint", endpoint, "bucket", cfg.R2BucketName)
+	return &r2Storage{client: client, uploader: uploader, bucket: cfg.R2BucketName}, nil
+}
+
+// isR2NotFound reports whether err is an S3 "no such key" style error.
+func isR2NotFound(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	var aErr awserr.Error
+	return errors.As(err, &aErr) && (aErr.Code() == s3.ErrCodeNoSuchKey || aErr.Code() == "NotFound")
+}
+
+// Put streams src to R2. Bodies larger than one part are sent as a multipart
+// upload, which the uploader aborts if reading src or uploading a part fails.
+// The abort is sent with the upload's context, so the upload ignores request
+// cancellation and relies on src failing instead; otherwise the parts of an
+// upload cut off by a shutdown would stay behind in the bucket.
+func (s *r2Storage) Put(ctx context.Context, key string, src io.Reader) (int64, error) {
+	counter := &countingReader{r: src}
+	_, err := s.uploader.UploadWithContext(context.WithoutCancel(ctx), &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   counter,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload to R2: %w", err)
+	}
+	return counter.n, nil
+}
+
+func (s *r2Storage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	obj, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isR2NotFound(err) {
+		return nil, nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to get R2 object %s: %w", key, err)
+	}
+	return obj.Body, &ObjectInfo{
+		Key:     key,
+		Size:    aws.Int64Value(obj.ContentLength),
+		ModTime: aws.TimeValue(obj.LastModified),
+		ETag:    aws.StringValue(obj.ETag),
+	}, nil
+}
+
+// GetConditional forwards Range, If-None-Match and If-Modified-Since to R2 so
+// partial and revalidated downloads are answered without fetching the whole object.
+func (s *r2Storage) GetConditional(ctx context.Context, key string, reqHeader http.Header) (*conditionalObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	// R2 cannot evaluate If-Range, so a conditional range is answered in full.
+	if rangeHeader := reqHeader.Get("Range"); rangeHeader != "" && reqHeader.Get("If-Range") == "" {
+		input.Range = aws.String(rangeHeader)
+	}
+	if ifNoneMatch := reqHeader.Get("If-None-Match"); ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	} else if ifModifiedSince := reqHeader.Get("If-Modified-Since"); ifModifiedSince != "" {
+		if t, err := http.ParseTime(ifModifiedSince); err == nil {
+			input.IfModifiedSince = aws.Time(t)
+		}
+	}
+	if ifMatch := reqHeader.Get("If-Match"); ifMatch != "" {
+		input.IfMatch = aws.String(ifMatch)
+	}
+	obj, err := s.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) {
+			switch reqErr.StatusCode() {
+			case http.StatusNotModified, http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+				return &conditionalObject{Status: reqErr.StatusCode(), Header: http.Header{}}, nil
+			}
+		}
+		if isR2NotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get R2 object %s: %w", key, err)
+	}
+	header := http.Header{}
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Length", strconv.FormatInt(aws.Int64Value(obj.ContentLength), 10))
+	if obj.ETag != nil {
+		header.Set("ETag", *obj.ETag)
+	}
+	if obj.LastModified != nil {
+		header.Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	}
+	status := http.StatusOK
+	if obj.ContentRange != nil {
+		status = http.StatusPartialContent
+		header.Set("Content-Range", *obj.ContentRange)
+	}
+	return &conditionalObject{Status: status, Header: header, Body: obj.Body}, nil
+}
+
+func (s *r2Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	head, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isR2NotFound(err) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat R2 object %s: %w", key, err)
+	}
+	return &ObjectInfo{
+		Key:     key,
+		Size:    aws.Int64Value(head.ContentLength),
+		ModTime: aws.TimeValue(head.LastModified),
+		ETag:    aws.StringValue(head.ETag),
+	}, nil
+}
+
+func (s *r2Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete R2 object %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *r2Storage) DeletePrefix(ctx context.Context, prefix string) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return ErrObjectNotFound
+	}
+	var firstErr error
+	for _, obj := range objects {
+		if delErr := s.Delete(ctx, obj.Key); delErr != nil {
+			loggerFrom(ctx).Error("Failed to delete object", "key", obj.Key, "error", delErr)
+			if firstErr == nil {
+				firstErr = delErr
+			}
+		}
+	}
+	return firstErr
+}
+
+func (s *r2Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	var objects []ObjectInfo
+	err := s.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			objects = append(objects, ObjectInfo{
+				Key:     *obj.Key,
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+				ETag:    aws.StringValue(obj.ETag),
+			})
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list R2 objects with prefix %q: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+// stagingKey is where bytes too few for a multipart part wait for the next chunk.
+func (s *r2Storage) stagingKey(upload *ChunkedUpload) string {
+	return internalPrefix + "staging/" + upload.Key
+}
+
+func (s *r2Storage) BeginChunked(ctx context.Context, upload *ChunkedUpload) error {
+	if upload.Length == 0 {
+		_, err := s.Put(ctx, upload.Key, bytes.NewReader(nil))
+		return err
+	}
+	out, err := s.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(upload.Key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start R2 multipart upload for %s: %w", upload.Key, err)
+	}
+	upload.MultipartID = aws.StringValue(out.UploadId)
+	return nil
+}
+
+// AppendChunk cuts the staged bytes plus src into parts of the uploader's part
+// size. A trailing remainder is either sent as the final part or staged until
+// the next chunk arrives, so memory use stays at one part per request.
+func (s *r2Storage) AppendChunk(ctx context.Context, upload *ChunkedUpload, src io.Reader) error {
+	if upload.complete() {
+		return nil
+	}
+	if upload.MultipartID == "" {
+		return fmt.Errorf("no multipart upload in progress for %s", upload.Key)
+	}
+	reader := src
+	if upload.Buffered > 0 {
+		staged, _, err := s.Get(ctx, s.stagingKey(upload))
+		if err != nil {
+			return fmt.Errorf("failed to read staged bytes for %s: %w", upload.Key, err)
+		}
+		defer staged.Close()
+		reader = io.MultiReader(staged, src)
+	}
+	committed := upload.Offset - upload.Buffered
+	buf := make([]byte, s.uploader.PartSize)
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if readErr == nil {
+			if err := s.uploadPart(ctx, upload, buf); err != nil {
+				upload.Offset, upload.Buffered = committed, 0
+				return err
+			}
+			committed += int64(n)
+			upload.Offset, upload.Buffered = committed, 0
+			continue
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			readErr = nil
+		}
+		if committed+int64(n) >= upload.Length {
+			if n > 0 {
+				if err := s.uploadPart(ctx, upload, buf[:n]); err != nil {
+					upload.Offset, upload.Buffered = committed, 0
+					return err
+				}
+			}
+			if err := s.completeMultipart(ctx, upload); err != nil {
+				upload.Offset, upload.Buffered = committed+int64(n), 0
+				return err
+			}
+			upload.Offset, upload.Buffered = upload.Length, 0
+			return readErr
+		}
+		if n > 0 {
+			if _, err := s.Put(ctx, s.stagingKey(upload), bytes.NewReader(buf[:n])); err != nil {
+				upload.Offset, upload.Buffered = committed, 0
+				return err
+			}
+		}
+		upload.Offset, upload.Buffered = committed+int64(n), int64(n)
+		return readErr
+	}
+}
+
+func (s *r2Storage) uploadPart(ctx context.Context, upload *ChunkedUpload, part []byte) error {
+	number := int64(len(upload.Parts) + 1)
+	out, err := s.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(upload.Key),
+		UploadId:   aws.String(upload.MultipartID),
+		PartNumber: aws.Int64(number),
+		Body:       bytes.NewReader(part),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d of %s: %w", number, upload.Key, err)
+	}
+	upload.Parts = append(upload.Parts, ChunkedPart{Number: number, ETag: aws.StringValue(out.ETag)})
+	return nil
+}
+
+func (s *r2Storage) completeMultipart(ctx context.Context, upload *ChunkedUpload) error {
+	parts := make([]*s3.CompletedPart, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(part.Number), ETag: aws.String(part.ETag)})
+	}
+	_, err := s.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(upload.Key),
+		UploadId:        aws.String(upload.MultipartID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload of %s: %w", upload.Key, err)
+	}
+	if delErr := s.Delete(ctx, s.stagingKey(upload)); delErr != nil {
+		loggerFrom(ctx).Error("Failed to delete staging object", "key", upload.Key, "error", delErr)
+	}
+	upload.MultipartID, upload.Parts = "", nil
+	return nil
+}
+
+func (s *r2Storage) AbortChunked(ctx context.Context, upload *ChunkedUpload) error {
+	if upload.MultipartID != "" {
+		_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(upload.Key),
+			UploadId: aws.String(upload.MultipartID),
+		})
+		if err != nil && !isR2NotFound(err) {
+			return fmt.Errorf("failed to abort multipart upload of %s: %w", upload.Key, err)
+		}
+	}
+	return s.Delete(ctx, s.stagingKey(upload))
+}
+
+// Expire deletes uploads whose newest object is older than cutoff, all keys
+// under one random ID together, as localStorage does. Internal objects expire
+// one by one. The bucket is swept page by page; keys are listed in order, so
+// the keys of one upload arrive one after another even across pages.
+func (s *r2Storage) Expire(ctx context.Context, cutoff time.Time) (cleanupStats, error) {
+	var stats cleanupStats
+	var upload []ObjectInfo
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if obj == nil || obj.Key == nil {
+				continue
+			}
+			info := ObjectInfo{
+				Key:     *obj.Key,
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			}
+			if strings.HasPrefix(info.Key, internalPrefix) {
+				s.expireObjects(ctx, []ObjectInfo{info}, cutoff, &stats)
+				continue
+			}
+			if len(upload) > 0 && uploadIDOf(upload[0].Key) != uploadIDOf(info.Key) {
+				s.expireObjects(ctx, upload, cutoff, &stats)
+				upload = upload[:0]
+			}
+			upload = append(upload, info)
+		}
+		return ctx.Err() == nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to list R2 objects: %w", err)
+	}
+	s.expireObjects(ctx, upload, cutoff, &stats)
+	return stats, nil
+}
+
+// uploadIDOf returns the random ID a storage key belongs to.
+func uploadIDOf(key string) string {
+	randomID, _, _ := strings.Cut(key, "/")
+	return randomID
+}
+
+// expireObjects deletes objects, which belong together, once the newest of
+// them is older than cutoff, and counts them as stored otherwise.
+func (s *r2Storage) expireObjects(ctx context.Context, objects []ObjectInfo, cutoff time.Time, stats *cleanupStats) {
+	for _, obj := range objects {
+		if obj.ModTime.IsZero() || obj.ModTime.After(cutoff) {
+			for _, obj := range objects {
+				if !strings.HasPrefix(obj.Key, internalPrefix) {
+					stats.StoredFiles++
+					stats.StoredBytes += obj.Size
+				}
+			}
+			return
+		}
+	}
+	for _, obj := range objects {
+		if delErr := s.Delete(ctx, obj.Key); delErr != nil {
+			logger.Error("R2 cleanup: failed to delete object", "key", obj.Key, "error", delErr)
+			stats.Failed++
+			continue
+		}
+		stats.Deleted++
+		logger.Info("R2 cleanup: deleted expired object", "key", obj.Key)
+	}
+}
+
+// Ready checks that the bucket exists and the credentials can reach it.
+func (s *r2Storage) Ready(ctx context.Context) error {
+	if _, err := s.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)}); err != nil {
+		return fmt.Errorf("R2 bucket %s is not reachable: %w", s.bucket, err)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io/protocols/resumable-upload),
+// with the creation and termination extensions. Upload URLs have the form
+// /files/<random_id>_<delete_token>, so only the uploader can resume or terminate them.
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination"
+	tusEndpoint    = "/files/"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusMiddleware sets the Tus-Resumable header on every response and rejects
+// requests speaking another protocol version.
+func tusMiddleware(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		abortWithError(c, http.StatusPreconditionFailed, "Unsupported Tus-Resumable version", nil)
+		return
+	}
+	if _, ok := store.(chunkedStorage); !ok {
+		abortWithError(c, http.StatusNotImplemented, fmt.Sprintf("Resumable uploads are not supported by %s storage", currentConfig().StorageType), nil)
+		return
+	}
+	c.Next()
+}
+
+func handleTusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(currentConfig().MaxUploadSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// handleTusCreate reserves a random ID for an upload of Upload-Length bytes.
+// The filename comes from the "filename" key of Upload-Metadata, and the
+// Max-Days and Max-Downloads headers apply as for other uploads; X-Encrypt and
+// X-Extract are refused.
+func handleTusCreate(c *gin.Context) {
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		abortWithError(c, http.StatusBadRequest, "Invalid or missing Upload-Length", err)
+		return
+	}
+	if limit := uploadSizeLimit(c.Request.Context()); length > limit {
+		abortWithError(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Upload-Length (%d bytes) exceeds maximum allowed size (%d bytes)", length, limit), nil)
+		return
+	}
+	filename := parseTusMetadata(c.GetHeader("Upload-Metadata"))["filename"]
+	sanitizedFilename, err := getSanitizedUserPath(filename)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid filename in Upload-Metadata", err)
+		return
+	}
+	options, err := parseUploadOptions(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid upload options", err)
+		return
+	}
+	// Both need the whole file at once, which chunks never give them.
+	encrypt, err := uploadFlag(c, encryptHeader, "encrypt")
+	if err == nil && (encrypt || options.extract) {
+		err = errors.New("encryption and archive extraction are not available for resumable uploads")
+	}
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "Invalid upload options", err)
+		return
+	}
+	randomID := generateUniqueID()
+	storageKey, err := buildAndVerifyStoragePath(randomID, sanitizedFilename)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to prepare storage path", err)
+		return
+	}
+	deleteToken, err := generateDeleteToken()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to record upload", err)
+		return
+	}
+	upload := &ChunkedUpload{Key: storageKey, Length: length}
+	if err := saveHashState(upload, sha256.New()); err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to prepare checksum", err)
+		return
+	}
+	if err := store.(chunkedStorage).BeginChunked(c.Request.Context(), upload); err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to prepare upload", err)
+		return
+	}
+	meta := &uploadMetadata{
+		ID:              randomID,
+		DeleteTokenHash: hashDeleteToken(deleteToken),
+		UploaderIP:      c.ClientIP(),
+		APIKey:          uploadKeyName(c.Request.Context()),
+		CreatedAt:       options.createdAt,
+		ExpiresAt:       options.expiresAt,
+		MaxDownloads:    options.maxDownloads,
+		PasswordHash:    options.passwordHash,
+		Files: []fileMetadata{{
+			Path:             sanitizedFilename,
+			OriginalFilename: filename,
+			ContentType:      detectContentType(sanitizedFilename, nil),
+			Size:             length,
+			UploadedAt:       options.createdAt,
+		}},
+		Resumable: upload,
+	}
+	if length == 0 {
+		finishTusUpload(meta)
+	}
+	if err := saveMetadata(c.Request.Context(), meta); err != nil {
+		store.(chunkedStorage).AbortChunked(c.Request.Context(), upload)
+		abortWithError(c, http.StatusInternalServerError, "Failed to record upload", err)
+		return
+	}
+	if length == 0 {
+		recordUpload(c)
+	}
+	baseURL := getBaseURL(c.Request)
+	requestLogger(c).Info("Resumable upload created", "id", randomID, "key", storageKey, "length", length)
+	c.Header("Location", fmt.Sprintf("%s%s%s_%s", baseURL, tusEndpoint, randomID, deleteToken))
+	c.Header("X-Download-Url", fmt.Sprintf("%s/%s/%s", baseURL, randomID, url.PathEscape(sanitizedFilename)))
+	c.Header(deleteTokenHeader, deleteToken)
+	c.Status(http.StatusCreated)
+}
+
+// handleTusHead reports the progress of an upload through Upload-Offset.
+func handleTusHead(c *gin.Context) {
+	meta, ok := loadTusUpload(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(meta.Resumable.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(meta.Resumable.Length, 10))
+	c.Status(http.StatusOK)
+}
+
+// handleTusPatch appends the request body at Upload-Offset. Whatever arrived
+// before the connection dropped is kept, so the client can resume from the
+// offset reported by HEAD.
+func handleTusPatch(c *gin.Context) {
+	if c.ContentType() != tusContentType {
+		abortWithError(c, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType, nil)
+		return
+	}
+	meta, ok := loadTusUpload(c)
+	if !ok {
+		return
+	}
+	randomID := meta.ID
+	unlock := lockMetadata(randomID)
+	defer unlock()
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return
+	}
+	upload := meta.Resumable
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		abortWithError(c, http.StatusConflict, fmt.Sprintf("Upload-Offset does not match current offset %d", upload.Offset), err)
+		return
+	}
+	if upload.complete() {
+		abortWithError(c, http.StatusForbidden, "Upload is already complete", nil)
+		return
+	}
+	var body io.Reader = io.LimitReader(c.Request.Body, upload.Length-upload.Offset)
+	if upload.Offset == 0 {
+		contentType, sniffed, err := sniffContentType(body, meta.Files[0].Path)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "Failed to read upload body", err)
+			return
+		}
+		meta.Files[0].ContentType = contentType
+		body = sniffed
+	}
+	hasher := loadHashState(upload)
+	if hasher != nil {
+		body = io.TeeReader(body, hasher)
+	}
+	counter := &countingReader{r: body}
+	startOffset := upload.Offset
+	appendErr := store.(chunkedStorage).AppendChunk(c.Request.Context(), upload, counter)
+	if hasher != nil && upload.Offset-startOffset == counter.n {
+		if err := saveHashState(upload, hasher); err != nil {
+			requestLogger(c).Error("Resumable upload: failed to save checksum state", "id", randomID, "error", err)
+		}
+	} else {
+		// Some bytes that were hashed were not stored, so the checksum can no longer be trusted.
+		upload.HashState = nil
+	}
+	if upload.complete() {
+		finishTusUpload(meta)
+	}
+	if err := saveMetadata(c.Request.Context(), meta); err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to record upload progress", err)
+		return
+	}
+	if upload.complete() {
+		recordUpload(c)
+	}
+	if appendErr != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to store upload chunk", appendErr)
+		return
+	}
+	if upload.complete() {
+		requestLogger(c).Info("Resumable upload completed", "id", randomID, "length", upload.Length)
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// handleTusDelete terminates an upload and removes everything stored for it.
+func handleTusDelete(c *gin.Context) {
+	meta, ok := loadTusUpload(c)
+	if !ok {
+		return
+	}
+	randomID := meta.ID
+	unlock := lockMetadata(randomID)
+	defer unlock()
+	if !meta.Resumable.complete() {
+		if err := store.(chunkedStorage).AbortChunked(c.Request.Context(), meta.Resumable); err != nil {
+			requestLogger(c).Error("Resumable upload: failed to abort", "id", randomID, "error", err)
+		}
+	}
+	if err := store.DeletePrefix(c.Request.Context(), randomID+"/"); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusInternalServerError, "Failed to delete upload", err)
+		return
+	}
+	if err := deleteMetadata(c.Request.Context(), randomID); err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Failed to delete upload record", err)
+		return
+	}
+	requestLogger(c).Info("Resumable upload terminated", "id", randomID)
+	c.Status(http.StatusNoContent)
+}
+
+// loadTusUpload resolves the :upload_id parameter to its upload record,
+// checking the embedded delete token. It writes the error response itself.
+func loadTusUpload(c *gin.Context) (*uploadMetadata, bool) {
+	randomID, token := splitTusUploadID(c.Param("upload_id"))
+	if _, err := buildAndVerifyStoragePath(randomID, "."); err != nil || token == "" {
+		abortWithError(c, http.StatusNotFound, "Upload not found", err)
+		return nil, false
+	}
+	meta, err := loadMetadata(c.Request.Context(), randomID)
+	if errors.Is(err, ErrObjectNotFound) {
+		abortWithError(c, http.StatusNotFound, "Upload not found", err)
+		return nil, false
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, "Error loading upload record", err)
+		return nil, false
+	}
+	if meta.Resumable == nil || !meta.checkDeleteToken(token) {
+		abortWithError(c, http.StatusNotFound, "Upload not found", nil)
+		return nil, false
+	}
+	return meta, true
+}
+
+func splitTusUploadID(uploadID string) (randomID, token string) {
+	randomID, token, _ = strings.Cut(uploadID, "_")
+	return randomID, token
+}
+
+// finishTusUpload records the checksum once every byte has arrived.
+func finishTusUpload(meta *uploadMetadata) {
+	upload := meta.Resumable
+	if hasher := loadHashState(upload); hasher != nil {
+		meta.Files[0].SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	}
+	upload.HashState = nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated keys,
+// each followed by a space and a base64 value.
+func parseTusMetadata(header string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		values[key] = string(decoded)
+	}
+	return values
+}
+
+func saveHashState(upload *ChunkedUpload, hasher hash.Hash) error {
+	state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	upload.HashState = state
+	return nil
+}
+
+// loadHashState restores the checksum of the bytes received so far, or returns
+// nil if it is unknown.
+func loadHashState(upload *ChunkedUpload) hash.Hash {
+	if upload.HashState == nil {
+		return nil
+	}
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		return nil
+	}
+	return hasher
+}
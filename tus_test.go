@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTusTestServer serves the router from an empty memoryStorage.
+func newTusTestServer(t *testing.T) http.Handler {
+	t.Helper()
+	useMemoryStorage(t)
+	r, err := newRouter(currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func serveTus(handler http.Handler, method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// createTusUpload creates an upload of length bytes and returns its upload and
+// download paths.
+func createTusUpload(t *testing.T, handler http.Handler, length int64) (string, string) {
+	t.Helper()
+	w := serveTus(handler, http.MethodPost, tusEndpoint, map[string]string{
+		"Upload-Length":   strconv.FormatInt(length, 10),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")),
+	}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	download, err := url.Parse(w.Header().Get("X-Download-Url"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Path, download.Path
+}
+
+func patchTus(handler http.Handler, uploadPath string, offset int64, chunk string) *httptest.ResponseRecorder {
+	return serveTus(handler, http.MethodPatch, uploadPath, map[string]string{
+		"Content-Type":  tusContentType,
+		"Upload-Offset": strconv.FormatInt(offset, 10),
+	}, chunk)
+}
+
+func TestTusUploadInChunks(t *testing.T) {
+	handler := newTusTestServer(t)
+	uploadPath, downloadPath := createTusUpload(t, handler, 10)
+
+	if w := serveTus(handler, http.MethodGet, downloadPath, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("download before completion: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := patchTus(handler, uploadPath, 0, "0123"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("first chunk: status %d, offset %q, body %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+	if w := serveTus(handler, http.MethodHead, uploadPath, nil, ""); w.Header().Get("Upload-Offset") != "4" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("HEAD: offset %q, length %q, want 4 and 10", w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	// Bytes past Upload-Length are not stored.
+	if w := patchTus(handler, uploadPath, 4, "456789-extra"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("last chunk: status %d, offset %q, body %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+
+	w := serveTus(handler, http.MethodGet, downloadPath, nil, "")
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusOK || string(body) != "0123456789" {
+		t.Errorf("download: status %d, body %q, want 200 with %q", w.Code, body, "0123456789")
+	}
+}
+
+func TestTusRejectsWrongOffset(t *testing.T) {
+	handler := newTusTestServer(t)
+	uploadPath, _ := createTusUpload(t, handler, 10)
+	if w := patchTus(handler, uploadPath, 0, "0123"); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk: status %d, body %s", w.Code, w.Body)
+	}
+
+	for _, offset := range []int64{0, 3, 5, 10} {
+		if w := patchTus(handler, uploadPath, offset, "4567"); w.Code != http.StatusConflict {
+			t.Errorf("offset %d: status %d, want %d", offset, w.Code, http.StatusConflict)
+		}
+	}
+	w := serveTus(handler, http.MethodPatch, uploadPath, map[string]string{"Content-Type": tusContentType}, "4567")
+	if w.Code != http.StatusConflict {
+		t.Errorf("missing Upload-Offset: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := serveTus(handler, http.MethodHead, uploadPath, nil, ""); w.Header().Get("Upload-Offset") != "4" {
+		t.Errorf("offset after rejected chunks is %q, want 4", w.Header().Get("Upload-Offset"))
+	}
+
+	if w := patchTus(handler, uploadPath, 4, "456789"); w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: status %d, body %s", w.Code, w.Body)
+	}
+	if w := patchTus(handler, uploadPath, 10, "more"); w.Code != http.StatusForbidden {
+		t.Errorf("chunk after completion: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestTusCreateChecksLength(t *testing.T) {
+	handler := newTusTestServer(t)
+	useConfig(t, func(cfg *AppConfig) { cfg.MaxUploadSize = 100 })
+	tests := []struct {
+		length     string
+		wantStatus int
+	}{
+		{"100", http.StatusCreated},
+		{"101", http.StatusRequestEntityTooLarge},
+		{"-1", http.StatusBadRequest},
+		{"ten", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := serveTus(handler, http.MethodPost, tusEndpoint, map[string]string{
+			"Upload-Length":   tt.length,
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt")),
+		}, "")
+		if w.Code != tt.wantStatus {
+			t.Errorf("Upload-Length %q: status %d, want %d", tt.length, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestTusRequiresDeleteToken(t *testing.T) {
+	handler := newTusTestServer(t)
+	uploadPath, _ := createTusUpload(t, handler, 10)
+	randomID, _ := splitTusUploadID(strings.TrimPrefix(uploadPath, tusEndpoint))
+
+	for _, path := range []string{tusEndpoint + randomID, tusEndpoint + randomID + "_wrongtoken"} {
+		if w := patchTus(handler, path, 0, "0123"); w.Code != http.StatusNotFound {
+			t.Errorf("PATCH %s: status %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+		if w := serveTus(handler, http.MethodDelete, path, nil, ""); w.Code != http.StatusNotFound {
+			t.Errorf("DELETE %s: status %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+	if w := serveTus(handler, http.MethodDelete, uploadPath, nil, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE with token: status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := serveTus(handler, http.MethodHead, uploadPath, nil, ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD after termination: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// metricValue returns the current value of one series of m.
+func metricValue(m *metricVec, labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func TestTusUploadIsCountedOnce(t *testing.T) {
+	handler := newTusTestServer(t)
+	storage := string(currentConfig().StorageType)
+	uploads := metricValue(metricUploads, http.MethodPatch, storage)
+	bytesIn := metricValue(metricBytesIn, http.MethodPatch, storage)
+
+	uploadPath, _ := createTusUpload(t, handler, 10)
+	for _, chunk := range []struct {
+		offset int64
+		data   string
+	}{{0, "0123"}, {4, "456"}, {7, "789"}} {
+		if w := patchTus(handler, uploadPath, chunk.offset, chunk.data); w.Code != http.StatusNoContent {
+			t.Fatalf("chunk at %d: status %d, body %s", chunk.offset, w.Code, w.Body)
+		}
+		if chunk.offset < 7 && metricValue(metricUploads, http.MethodPatch, storage) != uploads {
+			t.Errorf("upload counted after the chunk at offset %d, before it completed", chunk.offset)
+		}
+	}
+	if got := metricValue(metricUploads, http.MethodPatch, storage); got != uploads+1 {
+		t.Errorf("uploads counted: %v, want %v", got-uploads, 1)
+	}
+	if got := metricValue(metricBytesIn, http.MethodPatch, storage); got != bytesIn+10 {
+		t.Errorf("bytes received: %v, want %v", got-bytesIn, 10)
+	}
+}
+
+func TestTusCreateRefusesWholeFileOptions(t *testing.T) {
+	handler := newTusTestServer(t)
+	tests := []struct {
+		header, value string
+		wantStatus    int
+	}{
+		{encryptHeader, "1", http.StatusBadRequest},
+		{extractHeader, "true", http.StatusBadRequest},
+		{encryptHeader, "maybe", http.StatusBadRequest},
+		{encryptHeader, "0", http.StatusCreated},
+		{extractHeader, "false", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		w := serveTus(handler, http.MethodPost, tusEndpoint, map[string]string{
+			"Upload-Length":   "10",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("notes.tar")),
+			tt.header:         tt.value,
+		}, "")
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: %s: status %d, want %d", tt.header, tt.value, w.Code, tt.wantStatus)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -14,14 +16,26 @@ import (
 
 const lowercaseLetters = "abcdefghijklmnopqrstuvwxyz"
 const idLength = 12
+const deleteTokenBytes = 16
 
+// abortWithError ends the request with a JSON error carrying the request ID. It
+// is logged at warn level for client errors and at error level for server errors.
 func abortWithError(c *gin.Context, statusCode int, message string, err error) {
-	fullMessage := message
+	level := slog.LevelWarn
+	if statusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []any{"status", statusCode, "method", c.Request.Method, "path", loggablePath(c), "ip", c.ClientIP()}
 	if err != nil {
-		fullMessage = fmt.Sprintf("%s: %v", message, err)
+		attrs = append(attrs, "error", err)
+	}
+	requestLogger(c).Log(c.Request.Context(), level, message, attrs...)
+	recordError(statusCode)
+	body := gin.H{"error": message}
+	if id := c.GetString(requestIDKey); id != "" {
+		body["request_id"] = id
 	}
-	logger.Printf("Client Error: %s (IP: %s, Request: %s %s)", fullMessage, c.ClientIP(), c.Request.Method, c.Request.URL.Path)
-	c.JSON(statusCode, gin.H{"error": message})
+	c.JSON(statusCode, body)
 	c.Abort()
 }
 
@@ -29,7 +43,7 @@ func generateUniqueID() string {
 	b := make([]byte, idLength)
 	_, err := rand.Read(b)
 	if err != nil {
-		logger.Printf("CRITICAL: crypto/rand.Read failed: %v. Using pseudo-random fallback.", err)
+		logger.Error("crypto/rand.Read failed, using pseudo-random fallback", "error", err)
 		fallbackResult := make([]byte, idLength)
 		ts := time.Now().UnixNano()
 		n := len(lowercaseLetters)
@@ -48,6 +62,14 @@ func generateUniqueID() string {
 	return string(result)
 }
 
+func generateDeleteToken() (string, error) {
+	b := make([]byte, deleteTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate delete token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func getSanitizedUserPath(pathParam string) (string, error) {
 	cleaned := strings.Trim(pathParam, "/ ")
 	if cleaned == "" {